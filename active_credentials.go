@@ -0,0 +1,87 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const activeCredentialsPath = "active-credentials/"
+
+// errMaxActiveCredentials is returned when a role already has as many active
+// credentials as it allows.
+type errMaxActiveCredentials struct {
+	role string
+	max  int
+}
+
+func (e *errMaxActiveCredentials) Error() string {
+	return fmt.Sprintf("role %q already has the maximum of %d active credentials, revoke some before requesting more", e.role, e.max)
+}
+
+type activeCredentials struct {
+	Count int `json:"count"`
+}
+
+func getActiveCredentials(ctx context.Context, s logical.Storage, role string) (int, error) {
+	entry, err := s.Get(ctx, activeCredentialsPath+role)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read active credentials count: %w", err)
+	}
+	if entry == nil {
+		return 0, nil
+	}
+
+	var active activeCredentials
+	if err := entry.DecodeJSON(&active); err != nil {
+		return 0, err
+	}
+	return active.Count, nil
+}
+
+func putActiveCredentials(ctx context.Context, s logical.Storage, role string, count int) error {
+	if count <= 0 {
+		return s.Delete(ctx, activeCredentialsPath+role)
+	}
+
+	entry, err := logical.StorageEntryJSON(activeCredentialsPath+role, &activeCredentials{Count: count})
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save active credentials count: %w", err)
+	}
+	return nil
+}
+
+// acquireCredential counts a new active credential for the role, failing with
+// errMaxActiveCredentials if max (when positive) is already reached.
+func (b *horizonBackend) acquireCredential(ctx context.Context, s logical.Storage, role string, max int) error {
+	lock := locksutil.LockForKey(b.roleLocks, role)
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, err := getActiveCredentials(ctx, s, role)
+	if err != nil {
+		return err
+	}
+	if max > 0 && count >= max {
+		return &errMaxActiveCredentials{role: role, max: max}
+	}
+	return putActiveCredentials(ctx, s, role, count+1)
+}
+
+// releaseCredential stops counting an active credential of the role.
+func (b *horizonBackend) releaseCredential(ctx context.Context, s logical.Storage, role string) error {
+	lock := locksutil.LockForKey(b.roleLocks, role)
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, err := getActiveCredentials(ctx, s, role)
+	if err != nil {
+		return err
+	}
+	return putActiveCredentials(ctx, s, role, count-1)
+}
@@ -0,0 +1,71 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxActiveCredentials(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	_, err := testCredsRoleCreate(t, b, s, "capped", map[string]interface{}{
+		"instance":               "mock",
+		"roles":                  []string{"operator"},
+		"max_active_credentials": 1,
+	})
+	require.NoError(t, err)
+
+	readCreds := func() (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/capped",
+			Storage:   s,
+		})
+	}
+	activeCredentials := func() int {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "roles/capped",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp.Data["active_credentials"].(int)
+	}
+
+	creds, err := readCreds()
+	require.NoError(t, err)
+	require.False(t, creds.IsError())
+	require.Equal(t, 1, activeCredentials())
+
+	resp, err := readCreds()
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	require.Contains(t, resp.Error().Error(), "maximum of 1 active credentials")
+
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret:    creds.Secret,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, activeCredentials())
+
+	// A failed request does not hold on to its slot.
+	m.failRoute(http.MethodPost, localsPath, 400)
+	_, err = readCreds()
+	require.Error(t, err)
+	require.Equal(t, 0, activeCredentials())
+	m.failRoute(http.MethodPost, localsPath, 0)
+
+	creds, err = readCreds()
+	require.NoError(t, err)
+	require.False(t, creds.IsError())
+	require.Equal(t, 1, activeCredentials())
+}
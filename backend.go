@@ -7,8 +7,10 @@ import (
 	"sync"
 	"time"
 
-	horizon "github.com/evertrust/horizon-go"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -19,8 +21,15 @@ const (
 )
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
+	logger, err := mountLogger(conf)
+	if err != nil {
+		return nil, err
+	}
+	mountConf := *conf
+	mountConf.Logger = logger
+
 	b := backend()
-	err := b.Setup(ctx, conf)
+	err = b.Setup(ctx, &mountConf)
 	if err != nil {
 		return nil, err
 	}
@@ -29,12 +38,38 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 
 type horizonBackend struct {
 	*framework.Backend
-	lock   sync.RWMutex
-	client *horizon.Horizon
+	lock     sync.RWMutex
+	breakers map[string]*circuitBreaker
+
+	// instanceLocks serialize the changes of the root credentials of an
+	// instance against the workflows using them: the former hold the lock of
+	// the instance exclusively, the latter shared. A workflow never holds the
+	// locks of two instances, which may share a lock entry.
+	instanceLocks []*locksutil.LockEntry
+	// roleLocks serialize the writes of a role, which are recorded in its
+	// history, and the updates of the per-role counters.
+	roleLocks []*locksutil.LockEntry
+	// entityLocks serialize the use of the per-entity accounts.
+	entityLocks []*locksutil.LockEntry
+	// libraryLocks serialize the check-outs of a library set.
+	libraryLocks []*locksutil.LockEntry
+	// revocationQueueLocks serialize the changes of a revocation queue
+	// entry.
+	revocationQueueLocks []*locksutil.LockEntry
+
+	tidyCASGuard uint32
+	tidyStatus   tidyStatus
 }
 
 func backend() *horizonBackend {
-	var b = horizonBackend{}
+	var b = horizonBackend{
+		breakers:             make(map[string]*circuitBreaker),
+		instanceLocks:        locksutil.CreateLocks(),
+		roleLocks:            locksutil.CreateLocks(),
+		entityLocks:          locksutil.CreateLocks(),
+		libraryLocks:         locksutil.CreateLocks(),
+		revocationQueueLocks: locksutil.CreateLocks(),
+	}
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
 
@@ -51,17 +86,35 @@ func backend() *horizonBackend {
 		Paths: framework.PathAppend(
 			pathListRoles(&b),
 			pathRoles(&b),
+			pathRoleHistory(&b),
 			[]*framework.Path{
 				pathConfig(&b),
+				pathBootstrap(&b),
 				pathCredentials(&b),
+				pathReconcile(&b),
 			},
+			pathRevocationQueue(&b),
 			pathRotateRootCredentials(&b),
+			pathTidy(&b),
+			pathAccounts(&b),
+			pathRevoke(&b),
+			pathLibrary(&b),
+			pathStatus(&b),
+			pathBundle(&b),
+			[]*framework.Path{
+				pathVersion(&b),
+			},
 		),
 		Secrets: []*framework.Secret{
 			secretCreds(&b),
+			secretLibrary(&b),
 		},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		BackendType:       logical.TypeLogical,
+		RunningVersion:    Version,
+		Invalidate:        b.invalidate,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: minRootCredRollbackAge,
+		PeriodicFunc:      b.periodicFunc,
 	}
 
 	return &b
@@ -70,13 +123,84 @@ func backend() *horizonBackend {
 func (b *horizonBackend) reset() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.client = nil
+	b.breakers = make(map[string]*circuitBreaker)
+}
+
+// resetInstance drops the state kept for an instance, so that it is rebuilt
+// from the new configuration on next use.
+func (b *horizonBackend) resetInstance(instance string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.breakers, instance)
 }
 
 func (b *horizonBackend) invalidate(ctx context.Context, key string) {
-	if key == "config" {
-		b.reset()
+	if strings.HasPrefix(key, horizonConfigPath) {
+		b.resetInstance(strings.TrimPrefix(key, horizonConfigPath))
+	}
+}
+
+// periodicFunc runs the background jobs of the engine. They only run where
+// storage can be written to.
+func (b *horizonBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	replicationState := b.System().ReplicationState()
+	if b.System().LocalMount() && replicationState.HasState(consts.ReplicationPerformanceStandby) ||
+		!b.System().LocalMount() && replicationState.HasState(consts.ReplicationPerformanceSecondary|consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	var errs *multierror.Error
+	if err := b.processRevocationQueue(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("revocation queue: %w", err))
+	}
+	if err := b.purgeRevokedAccounts(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("purge: %w", err))
+	}
+	if err := b.reconcileInstances(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("reconciliation: %w", err))
 	}
+	if err := b.probeInstances(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("status probe: %w", err))
+	}
+	if err := b.clearExpiredPreviousPasswords(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("previous root password: %w", err))
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// breaker returns the circuit breaker of an instance, creating it from the
+// instance configuration if needed.
+func (b *horizonBackend) breaker(instance string, config *horizonConfig) *circuitBreaker {
+	b.lock.RLock()
+	cb, ok := b.breakers[instance]
+	b.lock.RUnlock()
+	if ok {
+		return cb
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if cb, ok := b.breakers[instance]; ok {
+		return cb
+	}
+	cb = newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown)
+	b.breakers[instance] = cb
+	return cb
+}
+
+// breakerState returns the state of the circuit breaker of an instance.
+func (b *horizonBackend) breakerState(instance string) breakerState {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if cb, ok := b.breakers[instance]; ok {
+		return cb.currentState()
+	}
+	return breakerClosed
+}
+
+func (b *horizonBackend) instanceLock(instance string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.instanceLocks, instance)
 }
 
 func (b *horizonBackend) Role(ctx context.Context, s logical.Storage, roleName string) (*horizonRoleEntry, error) {
@@ -109,12 +233,7 @@ func (b *horizonBackend) getConfig(ctx context.Context, s logical.Storage, insta
 		return nil, fmt.Errorf("nothing found at path: %s", horizonConfigPath+instance)
 	}
 
-	var config horizonConfig
-	if err := entry.DecodeJSON(&config); err != nil {
-		return nil, err
-	}
-
-	return &config, nil
+	return decodeConfig(entry)
 }
 
 const backendHelp = `
@@ -92,3 +92,18 @@ func (e *testEnv) ReadUserToken(t *testing.T) {
 }
 
 var runAcceptanceTests = os.Getenv(envVarRunAccTests) == "1"
+
+func TestVersion(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	require.Equal(t, Version, b.PluginVersion().Version)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "version",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, Version, resp.Data["version"])
+	require.Contains(t, resp.Data, "commit")
+}
@@ -0,0 +1,366 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	horizon "github.com/evertrust/horizon-go"
+	hhttp "github.com/evertrust/horizon-go/http"
+	"github.com/evertrust/horizon-go/license"
+	"github.com/evertrust/horizon-go/localaccount"
+	"github.com/go-resty/resty/v2"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// horizonClient wraps the horizon-go client of a single configured instance.
+// Every call to Horizon goes through call, which applies the retry policy of
+// the instance and its circuit breaker.
+type horizonClient struct {
+	instance string
+	endpoint url.URL
+	username string
+	password string
+	// previousPassword is tried once when Horizon rejects password, during
+	// the grace window that follows a root rotation.
+	previousPassword string
+
+	retry   retryPolicy
+	breaker *circuitBreaker
+	timeout time.Duration
+	logger  log.Logger
+}
+
+// horizonResponseError is returned for every non-2xx answer from Horizon, so
+// that failures can be classified on their HTTP status code.
+type horizonResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *horizonResponseError) Error() string {
+	body := strings.TrimSpace(e.Body)
+	if body == "" {
+		return fmt.Sprintf("horizon returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("horizon returned HTTP %d: %s", e.StatusCode, body)
+}
+
+// getClient returns a client for the given instance, built from its stored
+// configuration. The circuit breaker is shared by every client of the same
+// instance.
+func (b *horizonBackend) getClient(ctx context.Context, s logical.Storage, instance string) (*horizonClient, error) {
+	config, err := b.getConfig(ctx, s, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.newClient(instance, config)
+}
+
+func (b *horizonBackend) newClient(instance string, config *horizonConfig) (*horizonClient, error) {
+	endpoint, err := url.Parse(config.HorizonEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	username, _ := config.ConnectionDetails["username"].(string)
+	password, _ := config.ConnectionDetails["password"].(string)
+
+	return &horizonClient{
+		instance:         instance,
+		endpoint:         *endpoint,
+		username:         username,
+		password:         password,
+		previousPassword: config.previousPassword(time.Now()),
+		retry:            config.retryPolicy(),
+		breaker:          b.breaker(instance, config),
+		timeout:          config.RequestTimeout,
+		logger:           b.Logger(),
+	}, nil
+}
+
+// withCredentials makes the client authenticate with the given account
+// instead of the configured one, with no fallback password.
+func (c *horizonClient) withCredentials(username string, password string) {
+	c.username = username
+	c.password = password
+	c.previousPassword = ""
+}
+
+// local returns a horizon-go local accounts client bound to ctx: every HTTP
+// request it sends carries the deadline and cancellation of ctx. Non-2xx
+// responses are turned into horizonResponseError before horizon-go gets to
+// decode them.
+func (c *horizonClient) local(ctx context.Context, password string) *localaccount.Client {
+	h := new(horizon.Horizon)
+	h.Init(c.endpoint, c.username, password, "", "")
+
+	if c.timeout > 0 {
+		h.Local.Resty.SetTimeout(c.timeout)
+	}
+	h.Local.Resty.OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+		req.SetContext(ctx)
+		return nil
+	})
+	h.Local.Resty.OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+		if resp.StatusCode() >= 300 {
+			return &horizonResponseError{
+				StatusCode: resp.StatusCode(),
+				Body:       resp.String(),
+			}
+		}
+		return nil
+	})
+
+	return h.Local
+}
+
+// createAccount creates a local account. When an attempt is lost in transit,
+// Horizon may have created the account anyway, and the next attempt fails
+// because it exists: that account is only taken as ours if it has the
+// contact we set.
+func (c *horizonClient) createAccount(ctx context.Context, identifier string, contact string) (*localaccount.LocalAccount, error) {
+	var acc *localaccount.LocalAccount
+	mayExist := false
+	err := c.call(ctx, "create", func(local *localaccount.Client) error {
+		var err error
+		acc, err = local.Create(identifier, contact)
+		if err != nil && mayExist && !isRetryable(err) && contact != "" {
+			if existing, getErr := local.GetAccount(identifier); getErr == nil && existing.Email == contact {
+				acc = existing
+				return nil
+			}
+		}
+		if err != nil && mayHaveReachedHorizon(err) {
+			mayExist = true
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (c *horizonClient) getAccount(ctx context.Context, identifier string) (*localaccount.LocalAccount, error) {
+	var acc *localaccount.LocalAccount
+	err := c.call(ctx, "get", func(local *localaccount.Client) error {
+		var err error
+		acc, err = local.GetAccount(identifier)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (c *horizonClient) setPassword(ctx context.Context, acc *localaccount.LocalAccount, password string) error {
+	return c.call(ctx, "set-password", func(local *localaccount.Client) error {
+		_, err := local.SetPassword(acc, password)
+		return err
+	}, password)
+}
+
+func (c *horizonClient) assignRoles(ctx context.Context, acc *localaccount.LocalAccount, contact string, roles []string) error {
+	return c.call(ctx, "assign-roles", func(local *localaccount.Client) error {
+		return local.AssignRoles(acc, contact, roles)
+	})
+}
+
+func (c *horizonClient) deleteAccount(ctx context.Context, acc *localaccount.LocalAccount) error {
+	return c.call(ctx, "delete", func(local *localaccount.Client) error {
+		return local.Delete(acc)
+	})
+}
+
+// listAccounts returns every local account of the instance.
+func (c *horizonClient) listAccounts(ctx context.Context) ([]*localaccount.LocalAccount, error) {
+	var accounts []*localaccount.LocalAccount
+	err := c.call(ctx, "list", func(local *localaccount.Client) error {
+		resp, err := local.GetAllAccounts()
+		if err != nil {
+			return err
+		}
+		accounts = nil
+		return json.Unmarshal(resp.Body(), &accounts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// getPrincipalInfos returns the roles and contact assigned to an account.
+func (c *horizonClient) getPrincipalInfos(ctx context.Context, identifier string) (*localaccount.PrincipalInfos, error) {
+	var infos *localaccount.PrincipalInfos
+	err := c.call(ctx, "get-principal", func(local *localaccount.Client) error {
+		infos = &localaccount.PrincipalInfos{}
+		_, err := local.Resty.R().
+			SetResult(infos).
+			Get("/api/v1/security/principalinfos/" + identifier)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// horizonRole is a role defined in Horizon.
+type horizonRole struct {
+	Name string `json:"name"`
+}
+
+// listRoles returns the roles defined in the instance. horizon-go has no
+// client for roles, so it calls GET /api/v1/security/roles of the Horizon v1
+// REST API, the version the localaccount client of horizon-go targets.
+func (c *horizonClient) listRoles(ctx context.Context) ([]*horizonRole, error) {
+	var roles []*horizonRole
+	err := c.call(ctx, "list-roles", func(local *localaccount.Client) error {
+		roles = nil
+		_, err := local.Resty.R().
+			SetResult(&roles).
+			Get("/api/v1/security/roles")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// getLicense returns the license information of the instance, which carries
+// its version. It goes through the license client of horizon-go, whose
+// errors carry no HTTP status: an answer from Horizon is told apart from a
+// failure to reach it with isHorizonAnswer, and is never retried.
+func (c *horizonClient) getLicense(ctx context.Context) (*license.LicenseInfo, error) {
+	var info *license.LicenseInfo
+	err := c.call(ctx, "get-license", func(_ *localaccount.Client) error {
+		var err error
+		info, err = c.license(ctx).Get()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// license returns a horizon-go license client. Its requests cannot carry
+// ctx, so the connection is dialed with ctx and bound to its deadline.
+func (c *horizonClient) license(ctx context.Context) *license.Client {
+	h := new(horizon.Horizon)
+	h.Init(c.endpoint, c.username, c.password, "", "")
+
+	dialer := &net.Dialer{Timeout: c.timeout}
+	h.Http.Transport.DialContext = func(_ context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		return conn, nil
+	}
+	if c.timeout > 0 {
+		h.Http.Transport.ResponseHeaderTimeout = c.timeout
+	}
+
+	return h.License
+}
+
+// call runs fn until it succeeds, fails with an error that is not worth
+// retrying, or the retry policy is exhausted. It fails fast with
+// errCircuitOpen while the instance circuit breaker is open, and stops as
+// soon as ctx is done. If Horizon rejects the password, the previous one is
+// tried once. The secrets sent by fn are redacted from the logs.
+func (c *horizonClient) call(ctx context.Context, op string, fn func(*localaccount.Client) error, secrets ...string) error {
+	err := c.callWith(ctx, op, c.password, fn, secrets)
+	if err != nil && isUnauthorized(err) && c.previousPassword != "" {
+		c.logger.Warn("horizon rejected the root password, falling back to the previous one", "instance", c.instance, "horizon_operation", op)
+		err = c.callWith(ctx, op, c.previousPassword, fn, secrets)
+	}
+	return err
+}
+
+// callWith is call, authenticating with the given password.
+func (c *horizonClient) callWith(ctx context.Context, op string, password string, fn func(*localaccount.Client) error, secrets []string) error {
+	local := c.local(ctx, password)
+	hidden := append([]string{c.password, c.previousPassword}, secrets...)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("horizon %s on instance %q: %w", op, c.instance, err)
+		}
+		if err := c.breaker.allow(); err != nil {
+			return fmt.Errorf("horizon %s on instance %q: %w", op, c.instance, err)
+		}
+
+		start := time.Now()
+		err = fn(local)
+		emitHorizonCall(c.instance, op, start, err)
+		if err == nil {
+			c.logger.Trace("horizon call succeeded", "instance", c.instance, "horizon_operation", op, "attempt", attempt+1, "duration", time.Since(start))
+			c.breaker.success()
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The caller went away, this says nothing about Horizon health.
+			c.breaker.release()
+			return fmt.Errorf("horizon %s on instance %q: %w", op, c.instance, ctxErr)
+		}
+
+		retryable := isRetryable(err)
+		c.logger.Debug("horizon call failed", "instance", c.instance, "horizon_operation", op, "attempt", attempt+1, "retryable", retryable,
+			"error", redact(err.Error(), hidden...))
+		if retryable {
+			c.breaker.failure()
+		} else {
+			// The instance answered, so it is up.
+			c.breaker.success()
+		}
+
+		if !retryable || attempt >= c.retry.MaxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("horizon %s on instance %q: %w (last error: %s)", op, c.instance, ctx.Err(), err)
+		case <-time.After(c.retry.backoff(attempt)):
+		}
+	}
+
+	return fmt.Errorf("horizon %s on instance %q: %w", op, c.instance, err)
+}
+
+// isNotFound reports whether err is a 404 answer from Horizon.
+func isNotFound(err error) bool {
+	var respErr *horizonResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == 404
+}
+
+// isHorizonAnswer reports whether err is an error answer from Horizon, as
+// opposed to a failure to reach it.
+func isHorizonAnswer(err error) bool {
+	var respErr *horizonResponseError
+	var apiErr *hhttp.HorizonErrorResponse
+	var multiErr *hhttp.HorizonMultipleErrorsResponse
+	return errors.As(err, &respErr) || errors.As(err, &apiErr) || errors.As(err, &multiErr)
+}
+
+// isUnauthorized reports whether err is a 401 answer from Horizon.
+func isUnauthorized(err error) bool {
+	var respErr *horizonResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == 401
+}
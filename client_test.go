@@ -0,0 +1,145 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testClient(t *testing.T, b *horizonBackend, m *mockHorizon, config *horizonConfig) *horizonClient {
+	t.Helper()
+
+	config.HorizonEndpoint = m.URL
+	config.ConnectionDetails = map[string]interface{}{
+		"username": username,
+		"password": password,
+	}
+	config.RetryMinBackoff = time.Millisecond
+	config.RetryMaxBackoff = 5 * time.Millisecond
+
+	client, err := b.newClient(t.Name(), config)
+	require.NoError(t, err)
+	return client
+}
+
+func TestClientRetry(t *testing.T) {
+	b, _ := getTestBackend(t)
+	ctx := context.Background()
+
+	t.Run("retries transient failures", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 3})
+
+		m.failNext(http.StatusServiceUnavailable, http.StatusBadGateway)
+		acc, err := client.createAccount(ctx, "retried", "contact@example.com")
+		require.NoError(t, err)
+		require.Equal(t, "retried", acc.Identifier)
+		require.Equal(t, 3, m.callCount())
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 1})
+
+		m.failNext(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		_, err := client.getAccount(ctx, "unknown")
+		require.Error(t, err)
+		require.Equal(t, 2, m.callCount())
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 3})
+
+		_, err := client.getAccount(ctx, "unknown")
+		require.True(t, isNotFound(err))
+		require.Equal(t, 1, m.callCount())
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 3})
+		client.retry.MinBackoff = time.Hour
+		client.retry.MaxBackoff = time.Hour
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		m.failNext(http.StatusServiceUnavailable)
+		_, err := client.getAccount(ctx, "unknown")
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Equal(t, 1, m.callCount())
+	})
+}
+
+func TestClientCreateAccountLostAnswer(t *testing.T) {
+	b, _ := getTestBackend(t)
+	ctx := context.Background()
+
+	t.Run("adopts the account created by a lost attempt", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 3})
+
+		m.dropNext(http.MethodPost, localsPath)
+		acc, err := client.createAccount(ctx, "lost", "contact@example.com")
+		require.NoError(t, err)
+		require.Equal(t, "lost", acc.Identifier)
+		require.Equal(t, "contact@example.com", acc.Email)
+		require.Equal(t, 3, m.callCount())
+	})
+
+	t.Run("does not adopt an account with another contact", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 3})
+
+		m.dropNext(http.MethodPost, localsPath)
+		_, err := client.createAccount(ctx, "lost", "contact@example.com")
+		require.NoError(t, err)
+
+		m.dropNext(http.MethodPost, localsPath)
+		_, err = client.createAccount(ctx, "lost", "other@example.com")
+		require.Error(t, err)
+	})
+
+	t.Run("does not adopt after an answered failure", func(t *testing.T) {
+		m := newMockHorizon(t)
+		client := testClient(t, b, m, &horizonConfig{MaxRetries: 3})
+		_, err := client.createAccount(ctx, "existing", "contact@example.com")
+		require.NoError(t, err)
+
+		m.failNext(http.StatusServiceUnavailable)
+		_, err = client.createAccount(ctx, "existing", "contact@example.com")
+		require.Error(t, err)
+		require.Equal(t, 3, m.callCount())
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b, _ := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	m.addAccount("existing")
+
+	client := testClient(t, b, m, &horizonConfig{BreakerThreshold: 2})
+	client.breaker.cooldown = 50 * time.Millisecond
+
+	m.failNext(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	_, err := client.getAccount(ctx, "existing")
+	require.Error(t, err)
+	_, err = client.getAccount(ctx, "existing")
+	require.Error(t, err)
+	require.Equal(t, breakerOpen, client.breaker.currentState())
+
+	_, err = client.getAccount(ctx, "existing")
+	require.True(t, errors.Is(err, errCircuitOpen))
+	require.Equal(t, 2, m.callCount())
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = client.getAccount(ctx, "existing")
+	require.NoError(t, err)
+	require.Equal(t, breakerClosed, client.breaker.currentState())
+}
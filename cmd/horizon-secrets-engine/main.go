@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
+	metrics "github.com/armon/go-metrics"
 	horizon "github.com/evertrust/horizon-secret-engine"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
@@ -12,19 +14,56 @@ import (
 func main() {
 	apiClientMeta := &api.PluginAPIClientMeta{}
 	flags := apiClientMeta.FlagSet()
+	printVersion := flags.Bool("version", false, "Print the version of the plugin and exit.")
+	metricsSink := flags.String("metrics-sink", os.Getenv("HORIZON_METRICS_SINK"),
+		"URL of the sink the metrics of the plugin are sent to, such as statsd://127.0.0.1:8125 or statsite://127.0.0.1:8125.")
 	flags.Parse(os.Args[1:])
 
+	if *printVersion {
+		fmt.Println(horizon.VersionString())
+		return
+	}
+
 	tlsConfig := apiClientMeta.GetTLSConfig()
 	tlsProviderFunc := api.VaultPluginTLSProvider(tlsConfig)
 
+	// Mounts served by this process can set their own log level.
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:             hclog.Info,
+		Output:            os.Stderr,
+		JSONFormat:        true,
+		IndependentLevels: true,
+	})
+
+	// The plugin runs in its own process, out of reach of the telemetry of
+	// Vault: without a sink, metrics are dropped.
+	if *metricsSink != "" {
+		if err := setupMetrics(*metricsSink); err != nil {
+			logger.Error("failed to set up the metrics sink", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	err := plugin.ServeMultiplex(&plugin.ServeOpts{
 		BackendFactoryFunc: horizon.Factory,
 		TLSProviderFunc:    tlsProviderFunc,
+		Logger:             logger,
 	})
 	if err != nil {
-		logger := hclog.New(&hclog.LoggerOptions{})
-
 		logger.Error("plugin shutting down", "error", err)
 		os.Exit(1)
 	}
 }
+
+func setupMetrics(sinkURL string) error {
+	sink, err := metrics.NewMetricSinkFromURL(sinkURL)
+	if err != nil {
+		return err
+	}
+
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err = metrics.NewGlobal(conf, sink)
+	return err
+}
@@ -0,0 +1,202 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	dryRunStepConfig            = "config"
+	dryRunStepActiveCredentials = "active_credentials"
+	dryRunStepUsername          = "username"
+	dryRunStepPassword          = "password"
+	dryRunStepAuthenticate      = "authenticate"
+	dryRunStepRoles             = "roles"
+	dryRunStepContact           = "contact"
+)
+
+// dryRunStep is the outcome of a step of a dry run of credential issuance.
+type dryRunStep struct {
+	Name    string `json:"step"`
+	Success bool   `json:"success"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+// dryRun collects the steps of a dry run. The steps that depend on a failed
+// step are reported as skipped.
+type dryRun struct {
+	steps []*dryRunStep
+}
+
+func (d *dryRun) pass(name string, format string, args ...interface{}) {
+	d.steps = append(d.steps, &dryRunStep{Name: name, Success: true, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (d *dryRun) fail(name string, format string, args ...interface{}) {
+	d.steps = append(d.steps, &dryRunStep{Name: name, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (d *dryRun) skip(names ...string) {
+	for _, name := range names {
+		d.steps = append(d.steps, &dryRunStep{Name: name, Skipped: true, Detail: "skipped after a failed step"})
+	}
+}
+
+func (d *dryRun) success() bool {
+	for _, step := range d.steps {
+		if !step.Success {
+			return false
+		}
+	}
+	return true
+}
+
+// dryRunCredential goes through the issuance of a credential of the role as
+// described by spec, up to the checks Horizon would make on the account,
+// without creating it. Nothing is written to Horizon nor to storage.
+func (b *horizonBackend) dryRunCredential(ctx context.Context, req *logical.Request, logger log.Logger, role *horizonRoleEntry, spec *accountSpec) (*logical.Response, error) {
+	lock := b.instanceLock(spec.Instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	run := &dryRun{}
+	b.dryRunSteps(ctx, req, logger, role, spec, run)
+
+	steps, err := toResponseData(map[string]interface{}{"steps": run.steps})
+	if err != nil {
+		return nil, err
+	}
+	success := run.success()
+	logger.Info("credential dry run", "account", spec.Username, "success", success)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":  true,
+			"success":  success,
+			"role":     spec.Role,
+			"instance": spec.Instance,
+			"username": spec.Username,
+			"roles":    spec.Roles,
+			"contact":  spec.Contact,
+			"ttl":      int64(spec.TTL.Seconds()),
+			"steps":    steps["steps"],
+		},
+	}, nil
+}
+
+func (b *horizonBackend) dryRunSteps(ctx context.Context, req *logical.Request, logger log.Logger, role *horizonRoleEntry, spec *accountSpec, run *dryRun) {
+	config, err := b.getConfig(ctx, req.Storage, spec.Instance)
+	if err != nil {
+		run.fail(dryRunStepConfig, "%s", err)
+		run.skip(dryRunStepActiveCredentials, dryRunStepUsername, dryRunStepPassword, dryRunStepAuthenticate, dryRunStepRoles, dryRunStepContact)
+		return
+	}
+	run.pass(dryRunStepConfig, "instance %q at %s", spec.Instance, config.HorizonEndpoint)
+
+	active, err := getActiveCredentials(ctx, req.Storage, spec.Role)
+	switch {
+	case err != nil:
+		run.fail(dryRunStepActiveCredentials, "%s", err)
+	case role.MaxActiveCredentials == 0:
+		run.pass(dryRunStepActiveCredentials, "%d active, no maximum", active)
+	case active >= role.MaxActiveCredentials:
+		run.fail(dryRunStepActiveCredentials, "%d active, the maximum of %d is reached", active, role.MaxActiveCredentials)
+	default:
+		run.pass(dryRunStepActiveCredentials, "%d active, maximum %d", active, role.MaxActiveCredentials)
+	}
+
+	if role.AccountMode == accountModePerEntity {
+		if req.EntityID == "" {
+			run.fail(dryRunStepUsername, "the per_entity account mode requires a token bound to an identity entity")
+		} else {
+			spec.Username = entityUsername(config.UsernamePrefix, spec.Role, req.EntityID)
+			run.pass(dryRunStepUsername, "%s, the account of the entity", spec.Username)
+		}
+	} else {
+		ug, err := newUsernameGenerator(role.CredentialConfig)
+		var username string
+		if err == nil {
+			username, err = ug.generate(ctx, b)
+		}
+		if err != nil {
+			run.fail(dryRunStepUsername, "%s", err)
+		} else {
+			spec.Username = config.UsernamePrefix + username
+			run.pass(dryRunStepUsername, "%s", spec.Username)
+		}
+	}
+
+	pg, err := newPasswordGenerator(role.CredentialConfig)
+	if err == nil {
+		spec.Password, err = pg.generate(ctx, b)
+	}
+	switch {
+	case err != nil:
+		run.fail(dryRunStepPassword, "%s", err)
+	case pg.PasswordPolicy != "":
+		run.pass(dryRunStepPassword, "generated with password policy %q", pg.PasswordPolicy)
+	default:
+		run.pass(dryRunStepPassword, "generated with the default generator")
+	}
+
+	// The root password never ends up in the report.
+	rootPassword, _ := config.ConnectionDetails["password"].(string)
+	client, err := b.newClient(spec.Instance, config)
+	if err == nil {
+		client.logger = logger
+		// The root account may be looked up by itself; not finding it still
+		// means the credentials were accepted.
+		_, err = client.getAccount(ctx, config.rootUsername())
+		if isNotFound(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		run.fail(dryRunStepAuthenticate, "%s", redact(err.Error(), rootPassword, config.PreviousPassword))
+		run.skip(dryRunStepRoles)
+	} else {
+		run.pass(dryRunStepAuthenticate, "authenticated as %s", config.rootUsername())
+
+		defined, err := client.listRoles(ctx)
+		if err != nil {
+			run.fail(dryRunStepRoles, "%s", redact(err.Error(), rootPassword, config.PreviousPassword))
+		} else {
+			known := make(map[string]bool, len(defined))
+			for _, r := range defined {
+				known[r.Name] = true
+			}
+			var missing []string
+			for _, r := range spec.Roles {
+				if !known[r] {
+					missing = append(missing, r)
+				}
+			}
+			switch {
+			case len(missing) > 0:
+				run.fail(dryRunStepRoles, "unknown horizon roles: %s", strings.Join(missing, ", "))
+			case len(spec.Roles) == 0:
+				run.pass(dryRunStepRoles, "no roles to assign")
+			default:
+				run.pass(dryRunStepRoles, "%s", strings.Join(spec.Roles, ", "))
+			}
+		}
+	}
+
+	// Horizon only takes a bare email address as contact, which ParseAddress
+	// returns unchanged: a display name or angle brackets are rejected.
+	if spec.Contact == "" {
+		run.fail(dryRunStepContact, "no contact")
+	} else if addr, err := mail.ParseAddress(spec.Contact); err != nil {
+		run.fail(dryRunStepContact, "invalid contact %q: %s", spec.Contact, err)
+	} else if addr.Address != spec.Contact {
+		run.fail(dryRunStepContact, "invalid contact %q: not a bare email address", spec.Contact)
+	} else {
+		run.pass(dryRunStepContact, "%s", spec.Contact)
+	}
+}
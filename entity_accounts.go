@@ -0,0 +1,173 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// accountModePerLease creates a new account for every credential.
+	accountModePerLease = "per_lease"
+	// accountModePerEntity reuses one account per Vault entity, deleted when
+	// the last lease of the entity ends.
+	accountModePerEntity = "per_entity"
+
+	entityAccountsPath = "entity-accounts/"
+)
+
+func validAccountMode(mode string) bool {
+	return mode == accountModePerLease || mode == accountModePerEntity
+}
+
+// entityAccount binds a Vault entity to its account for a role, and counts
+// the leases handed out for it.
+type entityAccount struct {
+	Instance string `json:"instance"`
+	Username string `json:"username"`
+	Leases   int    `json:"leases"`
+}
+
+// entityUsername is the deterministic account name of an entity for a role.
+func entityUsername(prefix string, role string, entityID string) string {
+	return prefix + role + "-" + entityID
+}
+
+func entityAccountKey(role string, entityID string) string {
+	return entityAccountsPath + role + "/" + entityID
+}
+
+func (b *horizonBackend) entityLock(role string, entityID string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.entityLocks, role+"/"+entityID)
+}
+
+func getEntityAccount(ctx context.Context, s logical.Storage, role string, entityID string) (*entityAccount, error) {
+	entry, err := s.Get(ctx, entityAccountKey(role, entityID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entity account: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var binding entityAccount
+	if err := entry.DecodeJSON(&binding); err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+func putEntityAccount(ctx context.Context, s logical.Storage, role string, entityID string, binding *entityAccount) error {
+	entry, err := logical.StorageEntryJSON(entityAccountKey(role, entityID), binding)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save entity account: %w", err)
+	}
+	return nil
+}
+
+// issueEntityAccount hands out the account of the requesting entity, creating
+// it on first use. An existing account gets the new password, roles and
+// contact of the spec, so that every read rotates its password.
+func (b *horizonBackend) issueEntityAccount(ctx context.Context, req *logical.Request, client *horizonClient, spec *accountSpec) error {
+	lock := b.entityLock(spec.Role, req.EntityID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	binding, err := getEntityAccount(ctx, req.Storage, spec.Role, req.EntityID)
+	if err != nil {
+		return err
+	}
+	if binding == nil {
+		binding = &entityAccount{
+			Instance: spec.Instance,
+			Username: spec.Username,
+		}
+	}
+
+	// The account may outlive its binding, when it is kept by the revocation
+	// mode of the role or still waiting in the revocation queue.
+	acc, err := client.getAccount(ctx, spec.Username)
+	switch {
+	case isNotFound(err):
+		err = b.createManagedAccount(ctx, req, client, spec)
+	case err == nil:
+		err = client.setPassword(ctx, acc, spec.Password)
+		if err == nil {
+			err = client.assignRoles(ctx, acc, spec.Contact, spec.Roles)
+		}
+		if err == nil {
+			err = refreshManagedAccount(ctx, req, spec)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	binding.Leases++
+	return putEntityAccount(ctx, req.Storage, spec.Role, req.EntityID, binding)
+}
+
+// refreshManagedAccount updates the inventory record of a reused account.
+func refreshManagedAccount(ctx context.Context, req *logical.Request, spec *accountSpec) error {
+	managed, err := getManagedAccount(ctx, req.Storage, spec.Instance, spec.Username)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if managed == nil {
+		managed = &managedAccount{
+			Instance:  spec.Instance,
+			Username:  spec.Username,
+			CreatedAt: now,
+		}
+	}
+	managed.Role = spec.Role
+	managed.Roles = spec.Roles
+	managed.Contact = spec.Contact
+	managed.RequestID = req.ID
+	managed.EntityID = req.EntityID
+	managed.ClientTokenAccessor = req.ClientTokenAccessor
+	if expiresAt := now.Add(spec.TTL); expiresAt.After(managed.ExpiresAt) {
+		managed.ExpiresAt = expiresAt
+	}
+	managed.RevokedAt = time.Time{}
+	managed.RevocationMode = ""
+	managed.PurgeAt = time.Time{}
+	return putManagedAccount(ctx, req.Storage, managed)
+}
+
+// releaseEntityAccount stops counting a lease of the entity account, and
+// reports whether it was the last one, in which case the account must be
+// revoked. The caller holds the entity lock.
+func releaseEntityAccount(ctx context.Context, s logical.Storage, role string, entityID string) (bool, error) {
+	binding, err := getEntityAccount(ctx, s, role, entityID)
+	if err != nil {
+		return false, err
+	}
+	if binding != nil && binding.Leases > 1 {
+		binding.Leases--
+		return false, putEntityAccount(ctx, s, role, entityID, binding)
+	}
+
+	if err := s.Delete(ctx, entityAccountKey(role, entityID)); err != nil {
+		return false, fmt.Errorf("failed to delete entity account: %w", err)
+	}
+	return true, nil
+}
+
+// entityAccountInUse reports whether an entity account has active leases,
+// meaning that a pending revocation of it is obsolete.
+func entityAccountInUse(ctx context.Context, s logical.Storage, role string, entityID string) (bool, error) {
+	binding, err := getEntityAccount(ctx, s, role, entityID)
+	if err != nil {
+		return false, err
+	}
+	return binding != nil && binding.Leases > 0, nil
+}
@@ -0,0 +1,93 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerEntityAccounts(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"username_prefix": "vault-"})
+
+	_, err := testCredsRoleCreate(t, b, s, "shared", map[string]interface{}{
+		"instance":     "mock",
+		"roles":        []string{"operator"},
+		"account_mode": accountModePerEntity,
+	})
+	require.NoError(t, err)
+
+	readCreds := func(t *testing.T, entityID string) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/shared",
+			Storage:   s,
+			EntityID:  entityID,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+	revoke := func(t *testing.T, creds *logical.Response) {
+		t.Helper()
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    creds.Secret,
+		})
+		require.NoError(t, err)
+	}
+
+	resp := readCreds(t, "")
+	require.True(t, resp.IsError())
+
+	first := readCreds(t, "alice")
+	require.False(t, first.IsError())
+	accUsername := first.Data["username"].(string)
+	require.Equal(t, "vault-shared-alice", accUsername)
+
+	second := readCreds(t, "alice")
+	require.False(t, second.IsError())
+	require.Equal(t, accUsername, second.Data["username"])
+	require.NotEqual(t, first.Data["password"], second.Data["password"])
+	require.Equal(t, second.Data["password"], m.account(accUsername).Password)
+
+	other := readCreds(t, "bob")
+	require.NotEqual(t, accUsername, other.Data["username"])
+	require.Len(t, m.accountIdentifiers(), 2)
+
+	revoke(t, first)
+	require.NotNil(t, m.account(accUsername))
+
+	revoke(t, second)
+	require.Nil(t, m.account(accUsername))
+	binding, err := getEntityAccount(ctx, s, "shared", "alice")
+	require.NoError(t, err)
+	require.Nil(t, binding)
+
+	t.Run("queued revocation is dropped once handed out again", func(t *testing.T) {
+		creds := readCreds(t, "carol")
+		carolAccount := creds.Data["username"].(string)
+
+		m.failNext(500, 500, 500, 500)
+		revoke(t, creds)
+		queue, err := listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, queue, 1)
+		require.Equal(t, "carol", queue[0].EntityID)
+
+		readCreds(t, "carol")
+		queue[0].NextAttempt = queue[0].QueuedAt
+		require.NoError(t, putRevocationQueueEntry(ctx, s, queue[0]))
+		require.NoError(t, b.processRevocationQueue(ctx, s))
+
+		queue, err = listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, queue)
+		require.NotNil(t, m.account(carolAccount))
+	})
+}
@@ -0,0 +1,284 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/evertrust/horizon-go/localaccount"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	localsPath     = "/api/v1/security/identity/locals"
+	principalsPath = "/api/v1/security/principalinfos"
+	licensesPath   = "/api/v1/licenses"
+	rolesPath      = "/api/v1/security/roles"
+
+	mockHorizonVersion = "2.4.0"
+)
+
+// mockHorizon is an in-memory stand-in for the local accounts API of Horizon.
+type mockHorizon struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	accounts   map[string]*localaccount.LocalAccount
+	principals map[string]*localaccount.PrincipalInfos
+	roles      []string
+	failures   []int
+	drops      map[string]int
+	routes     map[string]int
+	calls      int
+}
+
+func newMockHorizon(t *testing.T) *mockHorizon {
+	t.Helper()
+
+	m := &mockHorizon{
+		accounts:   make(map[string]*localaccount.LocalAccount),
+		principals: make(map[string]*localaccount.PrincipalInfos),
+		routes:     make(map[string]int),
+		drops:      make(map[string]int),
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.handle))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// failNext makes the next calls answer with the given HTTP statuses.
+func (m *mockHorizon) failNext(statuses ...int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, statuses...)
+}
+
+// failRoute makes every call to the given route answer with status, until
+// it is reset with a zero status.
+func (m *mockHorizon) failRoute(method string, path string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status == 0 {
+		delete(m.routes, method+" "+path)
+		return
+	}
+	m.routes[method+" "+path] = status
+}
+
+// dropNext makes the mock carry out the next call to the given route but
+// close the connection instead of answering it, as if the answer was lost.
+func (m *mockHorizon) dropNext(method string, path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drops[method+" "+path]++
+}
+
+func (m *mockHorizon) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func (m *mockHorizon) account(identifier string) *localaccount.LocalAccount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accounts[identifier]
+}
+
+func (m *mockHorizon) accountIdentifiers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	identifiers := make([]string, 0, len(m.accounts))
+	for identifier := range m.accounts {
+		identifiers = append(identifiers, identifier)
+	}
+	return identifiers
+}
+
+func (m *mockHorizon) principal(identifier string) *localaccount.PrincipalInfos {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.principals[identifier]
+}
+
+func (m *mockHorizon) addAccount(identifier string, roles ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[identifier] = &localaccount.LocalAccount{Id: "id-" + identifier, Identifier: identifier}
+	if len(roles) > 0 {
+		m.principals[identifier] = &localaccount.PrincipalInfos{Identifier: identifier, Roles: roles}
+	}
+}
+
+func (m *mockHorizon) setPassword(identifier string, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[identifier].Password = password
+}
+
+// defineRoles adds roles to the roles defined in the mock.
+func (m *mockHorizon) defineRoles(roles ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roles = append(m.roles, roles...)
+}
+
+func (m *mockHorizon) deleteAccount(identifier string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.accounts, identifier)
+	delete(m.principals, identifier)
+}
+
+func (m *mockHorizon) handle(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls++
+	if len(m.failures) > 0 {
+		status := m.failures[0]
+		m.failures = m.failures[1:]
+		writeMockError(w, status, "injected failure")
+		return
+	}
+	if status, ok := m.routes[r.Method+" "+r.URL.Path]; ok {
+		writeMockError(w, status, "injected failure")
+		return
+	}
+	if m.drops[r.Method+" "+r.URL.Path] > 0 {
+		m.drops[r.Method+" "+r.URL.Path]--
+		conn := w
+		w = httptest.NewRecorder()
+		defer func() {
+			if hj, ok := conn.(http.Hijacker); ok {
+				if c, _, err := hj.Hijack(); err == nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+
+	// Only the credentials of the accounts it knows are checked.
+	if caller, ok := m.accounts[r.Header.Get("X-API-ID")]; ok && caller.Password != r.Header.Get("X-API-KEY") {
+		writeMockError(w, http.StatusUnauthorized, "bad credentials")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == localsPath:
+		var acc localaccount.LocalAccount
+		_ = json.NewDecoder(r.Body).Decode(&acc)
+		if _, ok := m.accounts[acc.Identifier]; ok {
+			writeMockError(w, http.StatusBadRequest, "account already exists")
+			return
+		}
+		acc.Id = "id-" + acc.Identifier
+		m.accounts[acc.Identifier] = &acc
+		writeMockJSON(w, http.StatusOK, acc)
+
+	case r.Method == http.MethodPatch && r.URL.Path == localsPath:
+		var acc localaccount.LocalAccount
+		_ = json.NewDecoder(r.Body).Decode(&acc)
+		existing, ok := m.accounts[acc.Identifier]
+		if !ok {
+			writeMockError(w, http.StatusNotFound, "unknown account")
+			return
+		}
+		existing.Password = acc.Password
+		writeMockJSON(w, http.StatusOK, existing)
+
+	case r.Method == http.MethodGet && r.URL.Path == localsPath:
+		accounts := make([]*localaccount.LocalAccount, 0, len(m.accounts))
+		for _, acc := range m.accounts {
+			accounts = append(accounts, acc)
+		}
+		writeMockJSON(w, http.StatusOK, accounts)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, localsPath+"/"):
+		acc, ok := m.accounts[strings.TrimPrefix(r.URL.Path, localsPath+"/")]
+		if !ok {
+			writeMockError(w, http.StatusNotFound, "unknown account")
+			return
+		}
+		writeMockJSON(w, http.StatusOK, acc)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, localsPath+"/"):
+		identifier := strings.TrimPrefix(r.URL.Path, localsPath+"/")
+		if _, ok := m.accounts[identifier]; !ok {
+			writeMockError(w, http.StatusNotFound, "unknown account")
+			return
+		}
+		delete(m.accounts, identifier)
+		delete(m.principals, identifier)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, principalsPath+"/"):
+		infos, ok := m.principals[strings.TrimPrefix(r.URL.Path, principalsPath+"/")]
+		if !ok {
+			writeMockError(w, http.StatusNotFound, "unknown principal")
+			return
+		}
+		writeMockJSON(w, http.StatusOK, infos)
+
+	case r.Method == http.MethodPost && r.URL.Path == principalsPath:
+		var infos localaccount.PrincipalInfos
+		_ = json.NewDecoder(r.Body).Decode(&infos)
+		m.principals[infos.Identifier] = &infos
+		writeMockJSON(w, http.StatusOK, infos)
+
+	case r.Method == http.MethodGet && r.URL.Path == licensesPath:
+		writeMockJSON(w, http.StatusOK, map[string]interface{}{"isValid": true, "version": mockHorizonVersion})
+
+	case r.Method == http.MethodGet && r.URL.Path == rolesPath:
+		roles := make([]map[string]string, 0, len(m.roles))
+		for _, name := range m.roles {
+			roles = append(roles, map[string]string{"name": name})
+		}
+		writeMockJSON(w, http.StatusOK, roles)
+
+	default:
+		writeMockError(w, http.StatusNotFound, "unknown route")
+	}
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeMockError(w http.ResponseWriter, status int, message string) {
+	writeMockJSON(w, status, map[string]string{
+		"error":   "MOCK",
+		"message": message,
+		"detail":  "",
+	})
+}
+
+// configureMockInstance points the given instance of the backend to the mock.
+func configureMockInstance(t *testing.T, b logical.Backend, s logical.Storage, instance string, m *mockHorizon, extra map[string]interface{}) {
+	t.Helper()
+
+	data := map[string]interface{}{
+		"username":         username,
+		"password":         password,
+		"horizon_endpoint": m.URL,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "config/" + instance,
+		Data:      data,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "unexpected error response: %v", resp)
+}
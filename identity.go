@@ -0,0 +1,118 @@
+package horizonsecretsengine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+)
+
+// hasIdentityMapping reports whether the role maps Vault identities onto
+// Horizon roles.
+func (r *horizonRoleEntry) hasIdentityMapping() bool {
+	return len(r.GroupRoles) > 0 || (r.MetadataKey != "" && len(r.MetadataRoles) > 0)
+}
+
+// rolesForEntity returns the Horizon roles to assign to an account requested
+// by the given entity: the static roles of the role, plus those mapped from
+// the groups the entity belongs to and from its metadata.
+func (b *horizonBackend) rolesForEntity(role *horizonRoleEntry, entityID string) ([]string, error) {
+	roles := append([]string(nil), role.Roles...)
+	if !role.hasIdentityMapping() || entityID == "" {
+		return roles, nil
+	}
+
+	if len(role.GroupRoles) > 0 {
+		groups, err := b.System().GroupsForEntity(entityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the groups of entity %q: %w", entityID, err)
+		}
+		for _, group := range groups {
+			roles = append(roles, role.GroupRoles[group.Name]...)
+		}
+	}
+
+	if role.MetadataKey != "" && len(role.MetadataRoles) > 0 {
+		entity, err := b.System().EntityInfo(entityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up entity %q: %w", entityID, err)
+		}
+		if entity != nil {
+			if value, ok := entity.Metadata[role.MetadataKey]; ok {
+				roles = append(roles, role.MetadataRoles[value]...)
+			}
+		}
+	}
+
+	return strutil.RemoveDuplicatesStable(roles, false), nil
+}
+
+// contactForEntity returns the contact of an account requested by the given
+// entity: the contact template of the role resolved against the entity, or
+// the static contact when the template does not resolve.
+func (b *horizonBackend) contactForEntity(role *horizonRoleEntry, entityID string) (string, error) {
+	if role.ContactTemplate == "" || entityID == "" {
+		return role.Contact, nil
+	}
+
+	entity, err := b.System().EntityInfo(entityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up entity %q: %w", entityID, err)
+	}
+	if entity == nil {
+		return role.Contact, nil
+	}
+	groups, err := b.System().GroupsForEntity(entityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the groups of entity %q: %w", entityID, err)
+	}
+
+	_, contact, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		Mode:   identitytpl.ACLTemplating,
+		String: role.ContactTemplate,
+		Entity: entity,
+		Groups: groups,
+	})
+	if errors.Is(err, identitytpl.ErrTemplateValueNotFound) || (err == nil && contact == "") {
+		return role.Contact, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve contact_template: %w", err)
+	}
+	return contact, nil
+}
+
+// validateContactTemplate checks the syntax of a contact template.
+func validateContactTemplate(tpl string) error {
+	_, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		Mode:              identitytpl.ACLTemplating,
+		String:            tpl,
+		ValidityCheckOnly: true,
+	})
+	return err
+}
+
+// parseRoleMapping turns the key/value pairs of a mapping field into lists of
+// Horizon roles, given as comma-separated values.
+func parseRoleMapping(pairs map[string]string) map[string][]string {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	mapping := make(map[string][]string, len(pairs))
+	for k, v := range pairs {
+		mapping[k] = strutil.RemoveEmpty(strutil.ParseStringSlice(v, ","))
+	}
+	return mapping
+}
+
+// formatRoleMapping is the inverse of parseRoleMapping.
+func formatRoleMapping(mapping map[string][]string) map[string]string {
+	pairs := make(map[string]string, len(mapping))
+	for k, v := range mapping {
+		pairs[k] = strings.Join(v, ",")
+	}
+	return pairs
+}
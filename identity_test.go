@@ -0,0 +1,113 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityRoleMapping(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	_, err := testCredsRoleCreate(t, b, s, "teams", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"reader"},
+		"group_roles": map[string]interface{}{
+			"pki-team":   "ca-admin, ra-operator",
+			"audit-team": "auditor",
+		},
+		"metadata_key": "department",
+		"metadata_roles": map[string]interface{}{
+			"security": "security-officer",
+		},
+	})
+	require.NoError(t, err)
+
+	sys := b.System().(*logical.StaticSystemView)
+	issue := func(t *testing.T, groups []string, department string) *logical.Response {
+		t.Helper()
+		sys.GroupsVal = nil
+		for _, name := range groups {
+			sys.GroupsVal = append(sys.GroupsVal, &logical.Group{Name: name})
+		}
+		sys.EntityVal = &logical.Entity{
+			ID:       "entity-id",
+			Metadata: map[string]string{"department": department},
+		}
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/teams",
+			Storage:   s,
+			EntityID:  "entity-id",
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		return resp
+	}
+
+	resp := issue(t, []string{"pki-team"}, "engineering")
+	require.Equal(t, []string{"reader", "ca-admin", "ra-operator"}, m.principal(resp.Data["username"].(string)).Roles)
+
+	resp = issue(t, []string{"audit-team", "other"}, "security")
+	require.Equal(t, []string{"reader", "auditor", "security-officer"}, m.principal(resp.Data["username"].(string)).Roles)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/teams",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"security": "security-officer"}, resp.Data["metadata_roles"])
+}
+
+func TestContactTemplate(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	resp, err := testCredsRoleCreate(t, b, s, "invalid", map[string]interface{}{
+		"instance":         "mock",
+		"contact_template": "{{identity.entity.metadata.email",
+	})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	_, err = testCredsRoleCreate(t, b, s, "templated", map[string]interface{}{
+		"instance":         "mock",
+		"roles":            []string{"operator"},
+		"contact":          "team@example.com",
+		"contact_template": "{{identity.entity.metadata.email}}",
+	})
+	require.NoError(t, err)
+
+	sys := b.System().(*logical.StaticSystemView)
+	issue := func(t *testing.T, metadata map[string]string) *logical.Response {
+		t.Helper()
+		sys.EntityVal = &logical.Entity{ID: "entity-id", Metadata: metadata}
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/templated",
+			Storage:   s,
+			EntityID:  "entity-id",
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		return resp
+	}
+
+	resp = issue(t, map[string]string{"email": "alice@example.com"})
+	require.Equal(t, "alice@example.com", resp.Secret.InternalData["contact"])
+	require.Equal(t, "alice@example.com", m.principal(resp.Data["username"].(string)).Contact)
+
+	resp = issue(t, nil)
+	require.Equal(t, "team@example.com", resp.Secret.InternalData["contact"])
+	require.Equal(t, "team@example.com", m.principal(resp.Data["username"].(string)).Contact)
+}
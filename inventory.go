@@ -0,0 +1,106 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const managedAccountsPath = "accounts/"
+
+// managedAccount is the inventory record of a Horizon account created by the
+// engine. It lives as long as the account does.
+type managedAccount struct {
+	Instance string   `json:"instance"`
+	Username string   `json:"username"`
+	Role     string   `json:"role"`
+	Roles    []string `json:"roles"`
+	Contact  string   `json:"contact"`
+	// LeaseID is empty until the lease is first renewed: Vault does not
+	// give the engine the lease ID when the credential is issued. Until
+	// then, the credential is identified by RequestID, Role and ExpiresAt.
+	LeaseID   string `json:"lease_id"`
+	RequestID string `json:"request_id"`
+	EntityID  string `json:"entity_id"`
+	// ClientTokenAccessor is the accessor of the token that requested the
+	// credential. It identifies the requester when the token has no entity.
+	ClientTokenAccessor string    `json:"client_token_accessor"`
+	CreatedAt           time.Time `json:"created_at"`
+	ExpiresAt           time.Time `json:"expires_at"`
+
+	// PasswordRotatedAt is when the password was last rotated mid-lease.
+	PasswordRotatedAt time.Time `json:"password_rotated_at"`
+	PasswordRotations int       `json:"password_rotations"`
+
+	// RevokedAt is set when the lease ended but the revocation mode of the
+	// role kept the account in Horizon. PurgeAt, if set, is when it will be
+	// deleted.
+	RevokedAt      time.Time `json:"revoked_at"`
+	RevocationMode string    `json:"revocation_mode"`
+	PurgeAt        time.Time `json:"purge_at"`
+}
+
+func (acc *managedAccount) revoked() bool {
+	return !acc.RevokedAt.IsZero()
+}
+
+func managedAccountKey(instance string, username string) string {
+	return managedAccountsPath + instance + "/" + username
+}
+
+func putManagedAccount(ctx context.Context, s logical.Storage, acc *managedAccount) error {
+	entry, err := logical.StorageEntryJSON(managedAccountKey(acc.Instance, acc.Username), acc)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save managed account: %w", err)
+	}
+	return nil
+}
+
+func getManagedAccount(ctx context.Context, s logical.Storage, instance string, username string) (*managedAccount, error) {
+	entry, err := s.Get(ctx, managedAccountKey(instance, username))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read managed account: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var acc managedAccount
+	if err := entry.DecodeJSON(&acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+func deleteManagedAccount(ctx context.Context, s logical.Storage, instance string, username string) error {
+	if err := s.Delete(ctx, managedAccountKey(instance, username)); err != nil {
+		return fmt.Errorf("failed to delete managed account: %w", err)
+	}
+	return nil
+}
+
+// listManagedAccounts returns the inventory of an instance.
+func listManagedAccounts(ctx context.Context, s logical.Storage, instance string) ([]*managedAccount, error) {
+	usernames, err := s.List(ctx, managedAccountsPath+instance+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]*managedAccount, 0, len(usernames))
+	for _, username := range usernames {
+		acc, err := getManagedAccount(ctx, s, instance, username)
+		if err != nil {
+			return nil, err
+		}
+		if acc != nil {
+			accounts = append(accounts, acc)
+		}
+	}
+	return accounts, nil
+}
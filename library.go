@@ -0,0 +1,250 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	libraryPath         = "library/"
+	libraryCheckOutPath = "library-checkouts/"
+)
+
+var errNoAccountAvailable = errors.New("no service account available for check-out")
+
+// librarySet is a pool of existing Horizon accounts lent out one at a time.
+type librarySet struct {
+	Instance                  string        `json:"instance"`
+	ServiceAccountNames       []string      `json:"service_account_names"`
+	TTL                       time.Duration `json:"ttl"`
+	MaxTTL                    time.Duration `json:"max_ttl"`
+	DisableCheckInEnforcement bool          `json:"disable_check_in_enforcement"`
+}
+
+// libraryCheckOut records who holds a service account. ID tells apart the
+// successive check-outs of an account, so that a stale lease cannot check in
+// the account of the next borrower.
+type libraryCheckOut struct {
+	ID                          string    `json:"id"`
+	BorrowerEntityID            string    `json:"borrower_entity_id"`
+	BorrowerClientTokenAccessor string    `json:"borrower_client_token_accessor"`
+	CheckedOutAt                time.Time `json:"checked_out_at"`
+}
+
+func (b *horizonBackend) libraryLock(set string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.libraryLocks, set)
+}
+
+func getLibrarySet(ctx context.Context, s logical.Storage, name string) (*librarySet, error) {
+	entry, err := s.Get(ctx, libraryPath+name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read library set: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var set librarySet
+	if err := entry.DecodeJSON(&set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+func putLibrarySet(ctx context.Context, s logical.Storage, name string, set *librarySet) error {
+	entry, err := logical.StorageEntryJSON(libraryPath+name, set)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save library set: %w", err)
+	}
+	return nil
+}
+
+func libraryCheckOutKey(set string, account string) string {
+	return libraryCheckOutPath + set + "/" + account
+}
+
+func getLibraryCheckOut(ctx context.Context, s logical.Storage, set string, account string) (*libraryCheckOut, error) {
+	entry, err := s.Get(ctx, libraryCheckOutKey(set, account))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read check-out: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var checkOut libraryCheckOut
+	if err := entry.DecodeJSON(&checkOut); err != nil {
+		return nil, err
+	}
+	return &checkOut, nil
+}
+
+func putLibraryCheckOut(ctx context.Context, s logical.Storage, set string, account string, checkOut *libraryCheckOut) error {
+	entry, err := logical.StorageEntryJSON(libraryCheckOutKey(set, account), checkOut)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save check-out: %w", err)
+	}
+	return nil
+}
+
+// libraryCheckOuts returns the current check-outs of a set, by account.
+func libraryCheckOuts(ctx context.Context, s logical.Storage, set string) (map[string]*libraryCheckOut, error) {
+	accounts, err := s.List(ctx, libraryCheckOutPath+set+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	checkOuts := make(map[string]*libraryCheckOut, len(accounts))
+	for _, account := range accounts {
+		checkOut, err := getLibraryCheckOut(ctx, s, set, account)
+		if err != nil {
+			return nil, err
+		}
+		if checkOut != nil {
+			checkOuts[account] = checkOut
+		}
+	}
+	return checkOuts, nil
+}
+
+// librarySetOf returns the set that lends the given account of an instance,
+// other than skip.
+func librarySetOf(ctx context.Context, s logical.Storage, instance string, account string, skip string) (string, error) {
+	names, err := s.List(ctx, libraryPath)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == skip {
+			continue
+		}
+		set, err := getLibrarySet(ctx, s, name)
+		if err != nil {
+			return "", err
+		}
+		if set == nil || set.Instance != instance {
+			continue
+		}
+		for _, n := range set.ServiceAccountNames {
+			if n == account {
+				return name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkOutLibraryAccount lends the first available account of the set to the
+// requester, with a freshly rotated password.
+func (b *horizonBackend) checkOutLibraryAccount(ctx context.Context, req *logical.Request, name string, set *librarySet) (string, string, *libraryCheckOut, error) {
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	checkOuts, err := libraryCheckOuts(ctx, req.Storage, name)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	for _, account := range set.ServiceAccountNames {
+		if checkOuts[account] != nil {
+			continue
+		}
+
+		password, err := b.rotateLibraryAccount(ctx, req.Storage, set, account)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return "", "", nil, err
+		}
+		checkOut := &libraryCheckOut{
+			ID:                          id,
+			BorrowerEntityID:            req.EntityID,
+			BorrowerClientTokenAccessor: req.ClientTokenAccessor,
+			CheckedOutAt:                time.Now(),
+		}
+		if err := putLibraryCheckOut(ctx, req.Storage, name, account, checkOut); err != nil {
+			return "", "", nil, err
+		}
+		return account, password, checkOut, nil
+	}
+
+	return "", "", nil, errNoAccountAvailable
+}
+
+// checkInLibraryAccount rotates the password of a checked out account and
+// makes it available again. If checkOutID is set, the account is only
+// checked in if it is still held under that check-out.
+func (b *horizonBackend) checkInLibraryAccount(ctx context.Context, s logical.Storage, name string, set *librarySet, account string, checkOutID string) error {
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	checkOut, err := getLibraryCheckOut(ctx, s, name, account)
+	if err != nil {
+		return err
+	}
+	if checkOut == nil || (checkOutID != "" && checkOut.ID != checkOutID) {
+		return nil
+	}
+
+	// Whoever held the account must not be able to use it anymore.
+	if _, err := b.rotateLibraryAccount(ctx, s, set, account); err != nil {
+		return err
+	}
+
+	if err := s.Delete(ctx, libraryCheckOutKey(name, account)); err != nil {
+		return fmt.Errorf("failed to delete check-out: %w", err)
+	}
+	b.Logger().Info("account checked in", "operation", "library-check-in", "set", name, "instance", set.Instance, "account", account, "check_out_id", checkOut.ID)
+	return nil
+}
+
+// rotateLibraryAccount sets a new password on a service account.
+func (b *horizonBackend) rotateLibraryAccount(ctx context.Context, s logical.Storage, set *librarySet, account string) (string, error) {
+	lock := b.instanceLock(set.Instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	config, err := b.getConfig(ctx, s, set.Instance)
+	if err != nil {
+		return "", err
+	}
+	client, err := b.newClient(set.Instance, config)
+	if err != nil {
+		return "", err
+	}
+
+	acc, err := client.getAccount(ctx, account)
+	if err != nil {
+		return "", err
+	}
+
+	generator := passwordGenerator{PasswordPolicy: config.PasswordPolicy}
+	password, err := generator.generate(ctx, b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	if err := client.setPassword(ctx, acc, password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
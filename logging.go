@@ -0,0 +1,52 @@
+package horizonsecretsengine
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// logLevelOption is the mount option overriding the log level of a mount,
+// as in: vault secrets enable -options=log_level=debug horizon-secrets-engine
+const logLevelOption = "log_level"
+
+const redacted = "<redacted>"
+
+// mountLogger returns the logger of a mount, at the level set by its
+// log_level option. It only gets a level of its own if the logger it is
+// derived from has independent levels.
+func mountLogger(conf *logical.BackendConfig) (log.Logger, error) {
+	logger := conf.Logger
+	if logger == nil {
+		logger = log.NewNullLogger()
+	}
+	logger = logger.With()
+
+	if raw, ok := conf.Config[logLevelOption]; ok && raw != "" {
+		level := log.LevelFromString(raw)
+		if level == log.NoLevel {
+			return nil, fmt.Errorf("invalid %s %q", logLevelOption, raw)
+		}
+		logger.SetLevel(level)
+	}
+	return logger, nil
+}
+
+// requestLogger returns a logger carrying the request ID, and the given
+// fields, such as the role, instance or account a request is about.
+func (b *horizonBackend) requestLogger(req *logical.Request, operation string, keyvals ...interface{}) log.Logger {
+	return b.Logger().With(append([]interface{}{"request_id", req.ID, "operation", operation}, keyvals...)...)
+}
+
+// redact hides the given secrets in msg. Horizon error messages may echo the
+// passwords that were sent.
+func redact(msg string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			msg = strings.ReplaceAll(msg, secret, redacted)
+		}
+	}
+	return msg
+}
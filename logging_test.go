@@ -0,0 +1,96 @@
+package horizonsecretsengine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by the logger.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMountLogLevel(t *testing.T) {
+	parent := hclog.New(&hclog.LoggerOptions{
+		Level:             hclog.Info,
+		Output:            &syncBuffer{},
+		IndependentLevels: true,
+	})
+
+	config := logical.TestBackendConfig()
+	config.Logger = parent
+	config.Config = map[string]string{logLevelOption: "debug"}
+	b, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+	require.True(t, b.Logger().IsDebug())
+	require.False(t, parent.IsDebug())
+
+	config.Config = map[string]string{logLevelOption: "verbose"}
+	_, err = Factory(context.Background(), config)
+	require.Error(t, err)
+}
+
+func TestRedact(t *testing.T) {
+	require.Equal(t, "bad password <redacted> for <redacted>", redact("bad password s3cret for root!", "s3cret", "", "root!"))
+}
+
+func TestCredsLogging(t *testing.T) {
+	out := &syncBuffer{}
+	config := logical.TestBackendConfig()
+	config.StorageView = new(logical.InmemStorage)
+	config.Logger = hclog.New(&hclog.LoggerOptions{Level: hclog.Trace, Output: out, JSONFormat: true})
+	config.System = logical.TestSystemView()
+	raw, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+	b, s := raw.(*horizonBackend), config.StorageView
+
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"max_retries": 0})
+	_, err = testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+	})
+	require.NoError(t, err)
+
+	m.failRoute(http.MethodPost, principalsPath, http.StatusForbidden)
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		ID:        "request-1",
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+	})
+	require.Error(t, err)
+
+	logs := out.String()
+	require.Contains(t, logs, `"request_id":"request-1"`)
+	require.Contains(t, logs, `"operation":"creds"`)
+	require.Contains(t, logs, `"role":"mock-role"`)
+	require.Contains(t, logs, `"horizon_operation":"assign-roles"`)
+	require.Contains(t, logs, `"account":"`)
+	require.Contains(t, logs, "failed to issue credential")
+
+	for _, acc := range m.accountIdentifiers() {
+		t.Fatalf("account %s was not deleted", acc)
+	}
+}
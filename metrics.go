@@ -0,0 +1,51 @@
+package horizonsecretsengine
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Metrics are emitted through the global go-metrics sink, under the
+// secrets.horizon prefix.
+var metricsPrefix = []string{"secrets", "horizon"}
+
+func metricKey(parts ...string) []string {
+	key := make([]string, 0, len(metricsPrefix)+len(parts))
+	key = append(key, metricsPrefix...)
+	return append(key, parts...)
+}
+
+func instanceLabels(instance string) []metrics.Label {
+	return []metrics.Label{{Name: "instance", Value: instance}}
+}
+
+func roleLabels(instance string, role string) []metrics.Label {
+	return []metrics.Label{
+		{Name: "instance", Value: instance},
+		{Name: "role", Value: role},
+	}
+}
+
+// emitOutcome counts an operation of the engine, such as creds.issue, as a
+// success or a failure.
+func emitOutcome(ok bool, labels []metrics.Label, parts ...string) {
+	outcome := "success"
+	if !ok {
+		outcome = "failure"
+	}
+	metrics.IncrCounterWithLabels(metricKey(append(parts, outcome)...), 1, labels)
+}
+
+// emitHorizonCall records the latency of a single call to Horizon, and
+// counts it as an error if it failed.
+func emitHorizonCall(instance string, op string, start time.Time, err error) {
+	labels := []metrics.Label{
+		{Name: "instance", Value: instance},
+		{Name: "operation", Value: op},
+	}
+	metrics.MeasureSinceWithLabels(metricKey("horizon", "request"), start, labels)
+	if err != nil {
+		metrics.IncrCounterWithLabels(metricKey("horizon", "error"), 1, labels)
+	}
+}
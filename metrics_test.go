@@ -0,0 +1,113 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// useInmemMetrics sends the metrics emitted during the test to an in-memory
+// sink.
+func useInmemMetrics(t *testing.T) *metrics.InmemSink {
+	t.Helper()
+
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	conf := metrics.DefaultConfig("vault")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(conf, sink)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = metrics.NewGlobal(metrics.DefaultConfig("vault"), &metrics.BlackholeSink{})
+	})
+	return sink
+}
+
+// counterValue sums the counters of the given name carrying the given label.
+func counterValue(sink *metrics.InmemSink, name string, label metrics.Label) int {
+	count := 0
+	for _, interval := range sink.Data() {
+		interval.RLock()
+		for _, c := range interval.Counters {
+			if c.Name != name {
+				continue
+			}
+			for _, l := range c.Labels {
+				if l == label {
+					count += c.Count
+				}
+			}
+		}
+		interval.RUnlock()
+	}
+	return count
+}
+
+func TestMetrics(t *testing.T) {
+	sink := useInmemMetrics(t)
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+		"ttl":      testTTL,
+		"max_ttl":  testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RenewOperation,
+		Storage:   s,
+		Secret:    resp.Secret,
+	})
+	require.NoError(t, err)
+
+	// The revocation is queued.
+	m.failNext(503, 503, 503, 503)
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret:    resp.Secret,
+	})
+	require.NoError(t, err)
+
+	role := metrics.Label{Name: "role", Value: "mock-role"}
+	require.Equal(t, 1, counterValue(sink, "vault.secrets.horizon.creds.issue.success", role))
+	require.Equal(t, 1, counterValue(sink, "vault.secrets.horizon.creds.renew.success", role))
+	require.Equal(t, 1, counterValue(sink, "vault.secrets.horizon.creds.revoke.failure", role))
+
+	instance := metrics.Label{Name: "instance", Value: "mock"}
+	require.Equal(t, 4, counterValue(sink, "vault.secrets.horizon.horizon.error", instance))
+
+	var latencies []string
+	for _, interval := range sink.Data() {
+		interval.RLock()
+		for _, sample := range interval.Samples {
+			if sample.Name == "vault.secrets.horizon.horizon.request" {
+				for _, l := range sample.Labels {
+					if l.Name == "operation" {
+						latencies = append(latencies, l.Value)
+					}
+				}
+			}
+		}
+		interval.RUnlock()
+	}
+	require.Subset(t, latencies, []string{"create", "set-password", "assign-roles", "get"})
+}
@@ -0,0 +1,132 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathAccounts(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("instance") + "/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"instance": {
+					Type:        framework.TypeString,
+					Description: "Instance of horizon.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathAccountsList,
+			},
+
+			HelpSynopsis:    pathAccountsHelpSyn,
+			HelpDescription: pathAccountsHelpDesc,
+		},
+		{
+			// Usernames come from username policies, and may hold any
+			// character.
+			Pattern: "accounts/" + framework.GenericNameRegex("instance") + "/(?P<username>.+)$",
+			Fields: map[string]*framework.FieldSchema{
+				"instance": {
+					Type:        framework.TypeString,
+					Description: "Instance of horizon.",
+				},
+				"username": {
+					Type:        framework.TypeString,
+					Description: "Identifier of the horizon account.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathAccountRead,
+			},
+
+			HelpSynopsis:    pathAccountsHelpSyn,
+			HelpDescription: pathAccountsHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathAccountsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	entries, err := req.Storage.List(ctx, managedAccountsPath+instance+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+func (b *horizonBackend) pathAccountRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	acc, err := getManagedAccount(ctx, req.Storage, instance, data.Get("username").(string))
+	if err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: acc.responseData(),
+	}, nil
+}
+
+func (acc *managedAccount) responseData() map[string]interface{} {
+	data := map[string]interface{}{
+		"instance":   acc.Instance,
+		"username":   acc.Username,
+		"role":       acc.Role,
+		"roles":      acc.Roles,
+		"contact":    acc.Contact,
+		"lease_id":   nil,
+		"request_id": acc.RequestID,
+		"entity_id":  acc.EntityID,
+		"created_at": acc.CreatedAt.Format(time.RFC3339),
+		"expires_at": acc.ExpiresAt.Format(time.RFC3339),
+
+		"password_rotations": acc.PasswordRotations,
+	}
+	if acc.LeaseID != "" {
+		data["lease_id"] = acc.LeaseID
+	}
+	if !acc.PasswordRotatedAt.IsZero() {
+		data["password_rotated_at"] = acc.PasswordRotatedAt.Format(time.RFC3339)
+	}
+	if acc.revoked() {
+		data["revoked_at"] = acc.RevokedAt.Format(time.RFC3339)
+		data["revocation_mode"] = acc.RevocationMode
+	}
+	if !acc.PurgeAt.IsZero() {
+		data["purge_at"] = acc.PurgeAt.Format(time.RFC3339)
+	}
+	return data
+}
+
+const pathAccountsHelpSyn = `
+List and read the horizon accounts managed by the engine.
+`
+
+const pathAccountsHelpDesc = `
+This path lists the horizon accounts of an instance that the engine currently
+manages, and reads the details of one of them: the role it was issued from,
+the horizon roles assigned to it, the entity that requested it, and when it
+was created and expires.
+
+Vault does not tell the engine the lease ID of a credential when it is
+issued, only when the lease is renewed: "lease_id" is null until then. The
+credential is identified by "request_id", which the audit log records next to
+its lease ID, along with "role" and "expires_at".
+`
@@ -0,0 +1,164 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagedAccounts(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	created := time.Now().Truncate(time.Second)
+	require.NoError(t, putManagedAccount(ctx, s, &managedAccount{
+		Instance:  "mock",
+		Username:  "vault-one",
+		Role:      "mock-role",
+		Roles:     []string{"operator"},
+		EntityID:  "entity",
+		CreatedAt: created,
+		ExpiresAt: created.Add(time.Hour),
+	}))
+	require.NoError(t, putManagedAccount(ctx, s, &managedAccount{Instance: "mock", Username: "vault-two"}))
+	require.NoError(t, putManagedAccount(ctx, s, &managedAccount{Instance: "other", Username: "vault-three"}))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "accounts/mock/",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"vault-one", "vault-two"}, resp.Data["keys"])
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/mock/vault-one",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "mock-role", resp.Data["role"])
+	require.Equal(t, []string{"operator"}, resp.Data["roles"])
+	require.Equal(t, "entity", resp.Data["entity_id"])
+	require.Equal(t, created.Format(time.RFC3339), resp.Data["created_at"])
+	require.Equal(t, created.Add(time.Hour).Format(time.RFC3339), resp.Data["expires_at"])
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/mock/vault-three",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
+
+func TestManagedAccountAfterIssue(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+		"ttl":      600,
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		ID:        "request-id",
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+		EntityID:  "alice",
+	})
+	require.NoError(t, err)
+	accPath := "accounts/mock/" + resp.Data["username"].(string)
+
+	readAccount := func(t *testing.T) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      accPath,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// Vault does not give the lease ID at issue time.
+	account := readAccount(t)
+	require.Nil(t, account.Data["lease_id"])
+	require.Equal(t, "request-id", account.Data["request_id"])
+	require.Equal(t, "mock-role", account.Data["role"])
+	require.NotEmpty(t, account.Data["expires_at"])
+
+	secret := resp.Secret
+	secret.LeaseID = "horizon/creds/mock-role/lease"
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RenewOperation,
+		Storage:   s,
+		Secret:    secret,
+	})
+	require.NoError(t, err)
+	require.Equal(t, secret.LeaseID, readAccount(t).Data["lease_id"])
+
+	t.Run("renewal does not shorten the expiry", func(t *testing.T) {
+		username := resp.Data["username"].(string)
+		acc, err := getManagedAccount(ctx, s, "mock", username)
+		require.NoError(t, err)
+		// As if a longer lease shared the account, in per_entity mode.
+		longer := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+		acc.ExpiresAt = longer
+		require.NoError(t, putManagedAccount(ctx, s, acc))
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+		acc, err = getManagedAccount(ctx, s, "mock", username)
+		require.NoError(t, err)
+		require.True(t, longer.Equal(acc.ExpiresAt), "expiry moved to %s", acc.ExpiresAt)
+	})
+}
+
+func TestManagedAccountWithUsernamePolicy(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+	b.System().(*logical.StaticSystemView).SetPasswordPolicy("emails", func() (string, error) {
+		return "-svc@example.com", nil
+	})
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance":          "mock",
+		"roles":             []string{"operator"},
+		"contact":           "team@example.com",
+		"ttl":               600,
+		"credential_config": map[string]interface{}{"username_policy": "emails"},
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "-svc@example.com", resp.Data["username"])
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/mock/-svc@example.com",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	require.Equal(t, "mock-role", resp.Data["role"])
+}
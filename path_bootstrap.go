@@ -0,0 +1,166 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const defaultServiceAccountName = "vault-secrets-engine"
+
+func pathBootstrap(b *horizonBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/" + framework.GenericNameRegex("instance") + "/bootstrap$",
+		Fields: map[string]*framework.FieldSchema{
+			"instance": {
+				Type:        framework.TypeString,
+				Description: "Instance of horizon.",
+			},
+			"username": {
+				Type:        framework.TypeString,
+				Description: "Identifier of a horizon administrator, used once to create the service account. Never stored.",
+			},
+			"password": {
+				Type:        framework.TypeString,
+				Description: "Password of the horizon administrator. Never stored.",
+			},
+			"service_account_name": {
+				Type:        framework.TypeString,
+				Description: "Identifier of the service account to create. Defaults to " + defaultServiceAccountName + ".",
+				Default:     defaultServiceAccountName,
+			},
+			"service_account_roles": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Horizon roles of the service account: those allowed to manage local accounts and their roles.",
+			},
+			"contact": {
+				Type:        framework.TypeString,
+				Description: "Contact of the service account.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathBootstrapWrite,
+				ForwardPerformanceSecondary: true,
+				ForwardPerformanceStandby:   true,
+			},
+		},
+
+		HelpSynopsis:    pathBootstrapHelpSyn,
+		HelpDescription: pathBootstrapHelpDesc,
+	}
+}
+
+func (b *horizonBackend) pathBootstrapWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	adminUsername := data.Get("username").(string)
+	adminPassword := data.Get("password").(string)
+	if adminUsername == "" || adminPassword == "" {
+		return logical.ErrorResponse("username and password of a horizon administrator are required"), nil
+	}
+	serviceAccount := data.Get("service_account_name").(string)
+	if serviceAccount == "" {
+		return logical.ErrorResponse("service_account_name cannot be empty"), nil
+	}
+	roles := data.Get("service_account_roles").([]string)
+	if len(roles) == 0 {
+		return logical.ErrorResponse("service_account_roles is required"), nil
+	}
+	contact := data.Get("contact").(string)
+
+	logger := b.requestLogger(req, "bootstrap", "instance", instance, "account", serviceAccount)
+
+	lock := b.instanceLock(instance)
+	lock.Lock()
+	defer lock.Unlock()
+
+	config, err := b.getConfig(ctx, req.Storage, instance)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	admin, err := b.newClient(instance, config)
+	if err != nil {
+		return nil, err
+	}
+	admin.withCredentials(adminUsername, adminPassword)
+	admin.logger = logger
+
+	generator := passwordGenerator{PasswordPolicy: config.PasswordPolicy}
+	password, err := generator.generate(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate password: %w", err)
+	}
+
+	// The administrator credentials are not stored, so a WAL entry could not
+	// be rolled back: clean up right away instead.
+	acc, err := admin.createAccount(ctx, serviceAccount, contact)
+	if err != nil {
+		logger.Error("failed to create service account", "error", redact(err.Error(), adminPassword))
+		return nil, fmt.Errorf("failed to create service account: %w", err)
+	}
+	err = admin.setPassword(ctx, acc, password)
+	if err == nil {
+		err = admin.assignRoles(ctx, acc, contact, roles)
+	}
+	if err == nil {
+		// Make sure the engine can work with its own account before
+		// switching to it.
+		service, clientErr := b.newClient(instance, config)
+		if clientErr != nil {
+			err = clientErr
+		} else {
+			service.withCredentials(serviceAccount, password)
+			service.logger = logger
+			_, err = service.getAccount(ctx, serviceAccount)
+		}
+	}
+	if err != nil {
+		logger.Error("failed to set up service account, deleting it", "error", redact(err.Error(), adminPassword, password))
+		if deleteErr := admin.deleteAccount(context.Background(), acc); deleteErr != nil {
+			return nil, fmt.Errorf("failed to set up service account: %w, and to delete it: %s", err, deleteErr)
+		}
+		return nil, fmt.Errorf("failed to set up service account: %w", err)
+	}
+
+	if config.ConnectionDetails == nil {
+		config.ConnectionDetails = make(map[string]interface{})
+	}
+	config.ConnectionDetails["username"] = serviceAccount
+	config.ConnectionDetails["password"] = password
+	config.clearPreviousPassword()
+	if err := storeConfig(ctx, req.Storage, instance, config); err != nil {
+		return nil, err
+	}
+	b.resetInstance(instance)
+	logger.Info("switched to bootstrapped service account", "roles", roles)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username": serviceAccount,
+			"roles":    roles,
+		},
+	}, nil
+}
+
+const pathBootstrapHelpSyn = `
+Create a service account for the engine from one-time administrator credentials.
+`
+
+const pathBootstrapHelpDesc = `
+This path uses the credentials of a horizon administrator once, to create a
+local account dedicated to the engine with the given roles and a generated
+password. The configuration of the instance is then switched to that account.
+The administrator credentials are never stored, and rotating the root
+credentials no longer locks a person out of horizon.
+
+The service account is never flagged as unknown by reconciliation nor deleted
+by tidy, even if it matches the username_prefix of the instance.
+`
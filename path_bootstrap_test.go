@@ -0,0 +1,64 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrap(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"username_prefix": "vault-"})
+
+	bootstrap := func(d map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/mock/bootstrap",
+			Storage:   s,
+			Data:      d,
+		})
+	}
+
+	t.Run("failed setup deletes the account", func(t *testing.T) {
+		m.failRoute(http.MethodPost, principalsPath, http.StatusForbidden)
+		defer m.failRoute(http.MethodPost, principalsPath, 0)
+
+		_, err := bootstrap(map[string]interface{}{
+			"username":              "admin",
+			"password":              "admin-password",
+			"service_account_roles": "local-accounts-manager",
+		})
+		require.Error(t, err)
+		require.Nil(t, m.account(defaultServiceAccountName))
+	})
+
+	resp, err := bootstrap(map[string]interface{}{
+		"username":              "admin",
+		"password":              "admin-password",
+		"service_account_name":  "vault-engine",
+		"service_account_roles": "local-accounts-manager",
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "vault-engine", resp.Data["username"])
+	require.Equal(t, []string{"local-accounts-manager"}, m.principal("vault-engine").Roles)
+
+	config, err := b.getConfig(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Equal(t, "vault-engine", config.ConnectionDetails["username"])
+	require.Equal(t, m.account("vault-engine").Password, config.ConnectionDetails["password"])
+	for _, v := range config.ConnectionDetails {
+		require.NotEqual(t, "admin-password", v)
+	}
+
+	// The engine works with its own account, which is not an orphan.
+	report, err := b.reconcile(ctx, s, "mock", config)
+	require.NoError(t, err)
+	require.Empty(t, report.Unknown)
+	require.Empty(t, report.Errors)
+}
@@ -0,0 +1,537 @@
+package horizonsecretsengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// bundleSchemaVersion is the version of the bundles written by export. It is
+// bumped whenever the storage format of the configurations or roles changes,
+// and import converts the bundles of older versions.
+const bundleSchemaVersion = 1
+
+const (
+	bundleActionCreate    = "create"
+	bundleActionUpdate    = "update"
+	bundleActionUnchanged = "unchanged"
+)
+
+// bundleSecrets are the connection details left out of a bundle unless
+// secrets are included.
+var bundleSecrets = []string{"password", "private_key"}
+
+var bundleNameRegex = regexp.MustCompile("^" + framework.GenericNameRegex("name") + "$")
+
+// bundle is a portable copy of the configurations and roles of the engine.
+// Its entries are stored as they are in storage.
+type bundle struct {
+	SchemaVersion int                          `json:"schema_version"`
+	Configs       map[string]*horizonConfig    `json:"configs"`
+	Roles         map[string]*horizonRoleEntry `json:"roles"`
+}
+
+// bundleChange is the effect of importing a single entry of a bundle.
+type bundleChange struct {
+	Action  string   `json:"action"`
+	Changes []string `json:"changes,omitempty"`
+}
+
+func pathBundle(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "export$",
+			Fields: map[string]*framework.FieldSchema{
+				"include_secrets": {
+					Type:        framework.TypeBool,
+					Description: "Whether the root passwords and private keys are included. Requires a response-wrapped request.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathExportRead,
+			},
+
+			HelpSynopsis:    pathExportHelpSyn,
+			HelpDescription: pathExportHelpDesc,
+		},
+		{
+			Pattern: "import$",
+			Fields: map[string]*framework.FieldSchema{
+				"schema_version": {
+					Type:        framework.TypeInt,
+					Description: "Schema version of the bundle.",
+				},
+				"exported_at": {
+					Type:        framework.TypeString,
+					Description: "Time the bundle was exported at. Ignored.",
+				},
+				"configs": {
+					Type:        framework.TypeMap,
+					Description: "Configurations of the bundle, keyed by instance.",
+				},
+				"roles": {
+					Type:        framework.TypeMap,
+					Description: "Roles of the bundle, keyed by name.",
+				},
+				"dry_run": {
+					Type:        framework.TypeBool,
+					Description: "Report the changes the import would make, without making them.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathImportWrite,
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathImportHelpSyn,
+			HelpDescription: pathImportHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathExportRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	includeSecrets := data.Get("include_secrets").(bool)
+	if includeSecrets && (req.WrapInfo == nil || req.WrapInfo.TTL == 0) {
+		return logical.ErrorResponse("include_secrets requires a response-wrapped request"), nil
+	}
+
+	bdl := &bundle{
+		SchemaVersion: bundleSchemaVersion,
+		Configs:       make(map[string]*horizonConfig),
+		Roles:         make(map[string]*horizonRoleEntry),
+	}
+
+	instances, err := req.Storage.List(ctx, horizonConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		config, err := b.getConfig(ctx, req.Storage, instance)
+		if err != nil {
+			return nil, err
+		}
+		// The previous root password belongs to the rotations of this
+		// mount.
+		config.clearPreviousPassword()
+		if !includeSecrets {
+			for _, key := range bundleSecrets {
+				delete(config.ConnectionDetails, key)
+			}
+		}
+		bdl.Configs[instance] = config
+	}
+
+	names, err := req.Storage.List(ctx, horizonRolePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		role, err := b.getRole(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		bdl.Roles[name] = role
+	}
+
+	respData, err := toResponseData(bdl)
+	if err != nil {
+		return nil, err
+	}
+	respData["exported_at"] = time.Now().UTC().Format(time.RFC3339)
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *horizonBackend) pathImportWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	bdl, err := decodeBundle(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	dryRun := data.Get("dry_run").(bool)
+	logger := b.requestLogger(req, "import", "dry_run", dryRun)
+
+	// Every instance written to, or used by an imported role, is locked so
+	// that no workflow sees half of the bundle.
+	var configNames, roleNames, instances []string
+	for instance := range bdl.Configs {
+		configNames = append(configNames, instance)
+		instances = append(instances, instance)
+	}
+	for name, role := range bdl.Roles {
+		roleNames = append(roleNames, name)
+		instances = append(instances, role.Instance)
+	}
+	sort.Strings(configNames)
+	sort.Strings(roleNames)
+	if !dryRun {
+		for _, lock := range locksutil.LocksForKeys(b.instanceLocks, instances) {
+			lock.Lock()
+			defer lock.Unlock()
+		}
+		for _, lock := range locksutil.LocksForKeys(b.roleLocks, roleNames) {
+			lock.Lock()
+			defer lock.Unlock()
+		}
+	}
+
+	var warnings []string
+	entries := make(map[string]*logical.StorageEntry)
+	configChanges := make(map[string]*bundleChange)
+	for _, instance := range configNames {
+		config := bdl.Configs[instance]
+		key := horizonConfigPath + instance
+
+		existing, err := req.Storage.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read horizon configuration: %w", err)
+		}
+		if existing != nil {
+			current := &horizonConfig{}
+			if err := existing.DecodeJSON(current); err != nil {
+				return nil, err
+			}
+			// Secrets left out of the bundle are kept, as long as they belong
+			// to the same root account.
+			sameRoot := reflect.DeepEqual(config.ConnectionDetails["username"], current.ConnectionDetails["username"])
+			for _, secret := range bundleSecrets {
+				if _, ok := config.ConnectionDetails[secret]; ok {
+					continue
+				}
+				if value, ok := current.ConnectionDetails[secret]; ok {
+					if !sameRoot {
+						warnings = append(warnings, fmt.Sprintf("config %q changes the root account, its stored %s is not kept", instance, secret))
+						continue
+					}
+					config.ConnectionDetails[secret] = value
+				}
+			}
+			// The previous root password only goes with the same root account.
+			if sameRoot && reflect.DeepEqual(config.ConnectionDetails["password"], current.ConnectionDetails["password"]) {
+				config.PreviousPassword = current.PreviousPassword
+				config.PreviousPasswordExpiresAt = current.PreviousPasswordExpiresAt
+			}
+		}
+		if _, ok := config.ConnectionDetails["password"]; !ok {
+			warnings = append(warnings, fmt.Sprintf("config %q has no password", instance))
+		}
+
+		entry, err := logical.StorageEntryJSON(key, config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal object to JSON: %w", err)
+		}
+		change, err := diffEntries(existing, entry)
+		if err != nil {
+			return nil, err
+		}
+		configChanges[instance] = change
+		if change.Action != bundleActionUnchanged {
+			entries[key] = entry
+		}
+	}
+
+	roleChanges := make(map[string]*bundleChange)
+	previousRoles := make(map[string]*horizonRoleEntry)
+	for _, name := range roleNames {
+		role := bdl.Roles[name]
+		if _, ok := bdl.Configs[role.Instance]; !ok {
+			existing, err := req.Storage.Get(ctx, horizonConfigPath+role.Instance)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read horizon configuration: %w", err)
+			}
+			if existing == nil {
+				return logical.ErrorResponse("role %q: unknown instance %q", name, role.Instance), nil
+			}
+		}
+
+		key := horizonRolePath + name
+		existing, err := req.Storage.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			previous := &horizonRoleEntry{}
+			if err := existing.DecodeJSON(previous); err != nil {
+				return nil, err
+			}
+			previousRoles[name] = previous
+		}
+		entry, err := logical.StorageEntryJSON(key, role)
+		if err != nil {
+			return nil, err
+		}
+		change, err := diffEntries(existing, entry)
+		if err != nil {
+			return nil, err
+		}
+		roleChanges[name] = change
+		if change.Action != bundleActionUnchanged {
+			entries[key] = entry
+		}
+	}
+
+	respData, err := toResponseData(map[string]interface{}{
+		"dry_run": dryRun,
+		"configs": configChanges,
+		"roles":   roleChanges,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := &logical.Response{
+		Data:     respData,
+		Warnings: warnings,
+	}
+	if dryRun {
+		return resp, nil
+	}
+
+	if err := putEntriesAtomically(ctx, req.Storage, entries); err != nil {
+		logger.Error("failed to import bundle", "error", err)
+		return nil, err
+	}
+	for _, instance := range configNames {
+		if configChanges[instance].Action == bundleActionUnchanged {
+			continue
+		}
+		b.resetInstance(instance)
+		if err := req.Storage.Delete(ctx, statusProbePath+instance); err != nil {
+			return nil, fmt.Errorf("failed to delete instance status: %w", err)
+		}
+	}
+
+	for _, name := range roleNames {
+		if roleChanges[name].Action == bundleActionUnchanged {
+			continue
+		}
+		err := b.recordRoleRevision(ctx, req, name, previousRoles[name], &roleRevision{
+			Operation: roleOperationImport,
+			Role:      bdl.Roles[name],
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Info("bundle imported", "configs", len(bdl.Configs), "roles", len(bdl.Roles), "written", len(entries))
+	return resp, nil
+}
+
+// decodeBundle decodes and validates the bundle given to import.
+func decodeBundle(data *framework.FieldData) (*bundle, error) {
+	version := data.Get("schema_version").(int)
+	switch {
+	case version <= 0:
+		return nil, fmt.Errorf("schema_version is required")
+	case version > bundleSchemaVersion:
+		return nil, fmt.Errorf("bundle schema version %d is newer than the supported version %d", version, bundleSchemaVersion)
+	}
+
+	bdl := &bundle{
+		SchemaVersion: version,
+		Configs:       make(map[string]*horizonConfig),
+		Roles:         make(map[string]*horizonRoleEntry),
+	}
+	for instance, raw := range data.Get("configs").(map[string]interface{}) {
+		if !bundleNameRegex.MatchString(instance) {
+			return nil, fmt.Errorf("invalid instance name %q", instance)
+		}
+		config := &horizonConfig{MaxRetries: defaultMaxRetries}
+		if err := decodeBundleEntry(raw, config); err != nil {
+			return nil, fmt.Errorf("config %q: %w", instance, err)
+		}
+		if err := config.validate(); err != nil {
+			return nil, fmt.Errorf("config %q: %w", instance, err)
+		}
+		if config.ConnectionDetails == nil {
+			config.ConnectionDetails = make(map[string]interface{})
+		}
+		config.clearPreviousPassword()
+		bdl.Configs[instance] = config
+	}
+	for name, raw := range data.Get("roles").(map[string]interface{}) {
+		if !bundleNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid role name %q", name)
+		}
+		role := &horizonRoleEntry{}
+		if err := decodeBundleEntry(raw, role); err != nil {
+			return nil, fmt.Errorf("role %q: %w", name, err)
+		}
+		if role.Instance == "" {
+			return nil, fmt.Errorf("role %q: missing instance", name)
+		}
+		if err := role.setCredentialConfig(role.CredentialConfig); err != nil {
+			return nil, fmt.Errorf("role %q: credential_config validation failed: %w", name, err)
+		}
+		if err := role.validate(); err != nil {
+			return nil, fmt.Errorf("role %q: %w", name, err)
+		}
+		bdl.Roles[name] = role
+	}
+	return bdl, nil
+}
+
+// decodeBundleEntry decodes an entry of a bundle as it is stored. Unknown
+// fields are rejected, they are most likely typos.
+func decodeBundleEntry(raw interface{}, out interface{}) error {
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
+
+// diffEntries compares an entry about to be written to the existing one, and
+// lists the fields that change. Nested fields are listed one by one, without
+// their values, which may be secret.
+func diffEntries(existing *logical.StorageEntry, updated *logical.StorageEntry) (*bundleChange, error) {
+	if existing == nil {
+		return &bundleChange{Action: bundleActionCreate}, nil
+	}
+
+	var before, after map[string]interface{}
+	if err := existing.DecodeJSON(&before); err != nil {
+		return nil, err
+	}
+	if err := updated.DecodeJSON(&after); err != nil {
+		return nil, err
+	}
+
+	changes := diffMaps("", before, after)
+	if len(changes) == 0 {
+		return &bundleChange{Action: bundleActionUnchanged}, nil
+	}
+	sort.Strings(changes)
+	return &bundleChange{Action: bundleActionUpdate, Changes: changes}, nil
+}
+
+func diffMaps(prefix string, before map[string]interface{}, after map[string]interface{}) []string {
+	var changes []string
+	keys := make(map[string]struct{})
+	for k := range before {
+		keys[k] = struct{}{}
+	}
+	for k := range after {
+		keys[k] = struct{}{}
+	}
+	for k := range keys {
+		b, a := before[k], after[k]
+		bm, bok := b.(map[string]interface{})
+		am, aok := a.(map[string]interface{})
+		if bok && aok {
+			changes = append(changes, diffMaps(prefix+k+".", bm, am)...)
+			continue
+		}
+		if !reflect.DeepEqual(b, a) {
+			changes = append(changes, prefix+k)
+		}
+	}
+	return changes
+}
+
+// putEntriesAtomically writes every entry, or none: if a write fails, the
+// entries already written are put back as they were.
+func putEntriesAtomically(ctx context.Context, s logical.Storage, entries map[string]*logical.StorageEntry) error {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	previous := make(map[string]*logical.StorageEntry, len(keys))
+	for _, key := range keys {
+		entry, err := s.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", key, err)
+		}
+		previous[key] = entry
+	}
+
+	for i, key := range keys {
+		err := s.Put(ctx, entries[key])
+		if err == nil {
+			continue
+		}
+		errs := multierror.Append(nil, fmt.Errorf("failed to write %q: %w", key, err))
+
+		// The request context may be done already.
+		restoreCtx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+		for _, written := range keys[:i] {
+			var restoreErr error
+			if previous[written] == nil {
+				restoreErr = s.Delete(restoreCtx, written)
+			} else {
+				restoreErr = s.Put(restoreCtx, previous[written])
+			}
+			if restoreErr != nil {
+				errs = multierror.Append(errs, fmt.Errorf("failed to restore %q: %w", written, restoreErr))
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+// toResponseData turns v into response data, through its JSON encoding.
+func toResponseData(v interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+const pathExportHelpSyn = `
+Export the configurations and roles of the engine.
+`
+
+const pathExportHelpDesc = `
+This path returns a bundle of every instance configuration and role, which
+can be applied to this or another mount with the "import" path. The bundle
+carries a schema version, so that it can be imported by later versions of
+the engine.
+
+Root passwords and private keys are left out, unless "include_secrets" is
+set, which requires the response to be wrapped.
+`
+
+const pathImportHelpSyn = `
+Import a bundle of configurations and roles.
+`
+
+const pathImportHelpDesc = `
+This path applies a bundle returned by the "export" path. The bundle is
+validated as a whole before anything is written, and either every entry is
+written or none is. Entries that are not in the bundle are left untouched, as
+are the root passwords and private keys the bundle does not carry, unless it
+changes the root account of the instance.
+
+The response lists, for each entry of the bundle, whether it is created,
+updated or unchanged, and the fields that change. With "dry_run", nothing is
+written.
+`
@@ -0,0 +1,243 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStorage fails the writes of the keys with the given prefix.
+type failingStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestExportImport(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"max_retries": 1,
+	})
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+		"ttl":      600,
+		"max_ttl":  3600,
+	})
+	require.NoError(t, err)
+
+	export := func(t *testing.T, data map[string]interface{}, wrap *logical.RequestWrapInfo) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "export",
+			Data:      data,
+			WrapInfo:  wrap,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		return resp
+	}
+	importBundle := func(t *testing.T, s logical.Storage, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "import",
+			Data:      data,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	bundle := export(t, nil, nil).Data
+	require.Equal(t, bundleSchemaVersion, int(bundle["schema_version"].(float64)))
+	require.NotEmpty(t, bundle["exported_at"])
+	config := bundle["configs"].(map[string]interface{})["mock"].(map[string]interface{})
+	require.Equal(t, m.URL, config["horizon_endpoint"])
+	require.NotContains(t, config["connection_details"], "password")
+	role := bundle["roles"].(map[string]interface{})["mock-role"].(map[string]interface{})
+	require.Equal(t, "mock", role["instance"])
+
+	t.Run("secrets require wrapping", func(t *testing.T) {
+		resp := export(t, map[string]interface{}{"include_secrets": true}, nil)
+		require.True(t, resp.IsError())
+
+		resp = export(t, map[string]interface{}{"include_secrets": true}, &logical.RequestWrapInfo{TTL: time.Minute})
+		require.False(t, resp.IsError())
+		config := resp.Data["configs"].(map[string]interface{})["mock"].(map[string]interface{})
+		require.Equal(t, password, config["connection_details"].(map[string]interface{})["password"])
+	})
+
+	t.Run("unchanged bundle", func(t *testing.T) {
+		resp := importBundle(t, s, bundle)
+		require.False(t, resp.IsError(), "%v", resp)
+		require.Empty(t, resp.Warnings)
+		require.Equal(t, map[string]interface{}{"action": "unchanged"}, resp.Data["configs"].(map[string]interface{})["mock"])
+		require.Equal(t, map[string]interface{}{"action": "unchanged"}, resp.Data["roles"].(map[string]interface{})["mock-role"])
+
+		// The password left out of the bundle is kept.
+		stored, err := b.getConfig(ctx, s, "mock")
+		require.NoError(t, err)
+		require.Equal(t, password, stored.ConnectionDetails["password"])
+	})
+
+	t.Run("dry run reports the changes", func(t *testing.T) {
+		changed := export(t, nil, nil).Data
+		role := changed["roles"].(map[string]interface{})["mock-role"].(map[string]interface{})
+		role["ttl"] = int64(1200 * time.Second)
+		role["contact"] = "other@example.com"
+		changed["roles"].(map[string]interface{})["new-role"] = map[string]interface{}{
+			"instance": "mock",
+			"roles":    []string{"auditor"},
+		}
+		changed["dry_run"] = true
+
+		resp := importBundle(t, s, changed)
+		require.False(t, resp.IsError(), "%v", resp)
+		require.Equal(t, true, resp.Data["dry_run"])
+		roles := resp.Data["roles"].(map[string]interface{})
+		require.Equal(t, map[string]interface{}{
+			"action":  "update",
+			"changes": []interface{}{"contact", "ttl"},
+		}, roles["mock-role"])
+		require.Equal(t, map[string]interface{}{"action": "create"}, roles["new-role"])
+
+		stored, err := b.getRole(ctx, s, "mock-role")
+		require.NoError(t, err)
+		require.Equal(t, 600*time.Second, stored.TTL)
+		stored, err = b.getRole(ctx, s, "new-role")
+		require.NoError(t, err)
+		require.Nil(t, stored)
+
+		delete(changed, "dry_run")
+		resp = importBundle(t, s, changed)
+		require.False(t, resp.IsError(), "%v", resp)
+		stored, err = b.getRole(ctx, s, "mock-role")
+		require.NoError(t, err)
+		require.Equal(t, 1200*time.Second, stored.TTL)
+		require.Equal(t, "other@example.com", stored.Contact)
+		stored, err = b.getRole(ctx, s, "new-role")
+		require.NoError(t, err)
+		require.Equal(t, []string{"auditor"}, stored.Roles)
+
+		versions, err := listRoleRevisions(ctx, s, "mock-role")
+		require.NoError(t, err)
+		rev, err := getRoleRevision(ctx, s, "mock-role", versions[len(versions)-1])
+		require.NoError(t, err)
+		require.Equal(t, roleOperationImport, rev.Operation)
+		require.Equal(t, []string{"contact", "ttl"}, rev.Changes)
+	})
+
+	t.Run("into another mount", func(t *testing.T) {
+		other := &logical.InmemStorage{}
+		resp := importBundle(t, other, bundle)
+		require.False(t, resp.IsError(), "%v", resp)
+		require.Equal(t, []string{`config "mock" has no password`}, resp.Warnings)
+		require.Equal(t, map[string]interface{}{"action": "create"}, resp.Data["configs"].(map[string]interface{})["mock"])
+
+		stored, err := b.getConfig(ctx, other, "mock")
+		require.NoError(t, err)
+		require.Equal(t, 1, stored.MaxRetries)
+		role, err := b.getRole(ctx, other, "mock-role")
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, role.MaxTTL)
+	})
+
+	t.Run("invalid bundles are rejected as a whole", func(t *testing.T) {
+		tests := map[string]func(map[string]interface{}){
+			"missing schema version": func(b map[string]interface{}) {
+				delete(b, "schema_version")
+			},
+			"newer schema version": func(b map[string]interface{}) {
+				b["schema_version"] = bundleSchemaVersion + 1
+			},
+			"unknown instance": func(b map[string]interface{}) {
+				b["roles"].(map[string]interface{})["other-role"] = map[string]interface{}{"instance": "unknown"}
+			},
+			"invalid role": func(b map[string]interface{}) {
+				b["roles"].(map[string]interface{})["other-role"] = map[string]interface{}{
+					"instance": "mock",
+					"ttl":      int64(time.Hour),
+					"max_ttl":  int64(time.Minute),
+				}
+			},
+			"unknown field": func(b map[string]interface{}) {
+				b["configs"].(map[string]interface{})["mock"].(map[string]interface{})["max_retry"] = 2
+			},
+			"invalid name": func(b map[string]interface{}) {
+				b["roles"].(map[string]interface{})["../config"] = map[string]interface{}{"instance": "mock"}
+			},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				bundle := export(t, nil, nil).Data
+				bundle["configs"].(map[string]interface{})["mock"].(map[string]interface{})["max_retries"] = 5
+				tc(bundle)
+
+				resp := importBundle(t, s, bundle)
+				require.True(t, resp.IsError())
+
+				stored, err := b.getConfig(ctx, s, "mock")
+				require.NoError(t, err)
+				require.Equal(t, 1, stored.MaxRetries)
+			})
+		}
+	})
+
+	t.Run("failed writes are undone", func(t *testing.T) {
+		bundle := export(t, nil, nil).Data
+		bundle["configs"].(map[string]interface{})["mock"].(map[string]interface{})["max_retries"] = 5
+		bundle["roles"].(map[string]interface{})["mock-role"].(map[string]interface{})["contact"] = "failed@example.com"
+
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "import",
+			Data:      bundle,
+			Storage:   &failingStorage{Storage: s, prefix: horizonRolePath},
+		})
+		require.Error(t, err)
+
+		stored, err := b.getConfig(ctx, s, "mock")
+		require.NoError(t, err)
+		require.Equal(t, 1, stored.MaxRetries)
+		require.Equal(t, password, stored.ConnectionDetails["password"])
+		role, err := b.getRole(ctx, s, "mock-role")
+		require.NoError(t, err)
+		require.Equal(t, "other@example.com", role.Contact)
+	})
+
+	t.Run("secrets of another root account are not kept", func(t *testing.T) {
+		bundle := export(t, nil, nil).Data
+		config := bundle["configs"].(map[string]interface{})["mock"].(map[string]interface{})
+		config["connection_details"].(map[string]interface{})["username"] = "other-root"
+
+		resp := importBundle(t, s, bundle)
+		require.False(t, resp.IsError(), "%v", resp)
+		require.Equal(t, []string{
+			`config "mock" changes the root account, its stored password is not kept`,
+			`config "mock" has no password`,
+		}, resp.Warnings)
+
+		stored, err := b.getConfig(ctx, s, "mock")
+		require.NoError(t, err)
+		require.Equal(t, "other-root", stored.rootUsername())
+		require.NotContains(t, stored.ConnectionDetails, "password")
+	})
+}
@@ -2,7 +2,9 @@ package horizonsecretsengine
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/fatih/structs"
 
@@ -17,6 +19,92 @@ type horizonConfig struct {
 	RootCredentialsRotateStatements []string               `json:"root_rotation_statements" structs:"root_rotation_statements" mapstructure:"root_rotation_statements"`
 	PasswordPolicy                  string                 `json:"password_policy" structs:"password_policy" mapstructure:"password_policy"`
 	UsernamePolicy                  string                 `json:"username_template" structs:"username_template" mapstructure:"username_template"`
+
+	// Resilience settings of the calls made to this instance.
+	MaxRetries       int           `json:"max_retries" structs:"max_retries" mapstructure:"max_retries"`
+	RetryMinBackoff  time.Duration `json:"retry_min_backoff" structs:"retry_min_backoff" mapstructure:"retry_min_backoff"`
+	RetryMaxBackoff  time.Duration `json:"retry_max_backoff" structs:"retry_max_backoff" mapstructure:"retry_max_backoff"`
+	RequestTimeout   time.Duration `json:"request_timeout" structs:"request_timeout" mapstructure:"request_timeout"`
+	BreakerThreshold int           `json:"breaker_threshold" structs:"breaker_threshold" mapstructure:"breaker_threshold"`
+	BreakerCooldown  time.Duration `json:"breaker_cooldown" structs:"breaker_cooldown" mapstructure:"breaker_cooldown"`
+
+	// RevocationMaxAttempts is the number of times a queued revocation is
+	// retried before it is given up.
+	RevocationMaxAttempts int `json:"revocation_max_attempts" structs:"revocation_max_attempts" mapstructure:"revocation_max_attempts"`
+
+	// UsernamePrefix is prepended to the name of every account created by
+	// the engine, which lets it tell its own accounts apart in Horizon.
+	UsernamePrefix string `json:"username_prefix" structs:"username_prefix" mapstructure:"username_prefix"`
+
+	// Reconciliation of the managed accounts against Horizon.
+	ReconcileInterval      time.Duration `json:"reconcile_interval" structs:"reconcile_interval" mapstructure:"reconcile_interval"`
+	ReconcileRepair        bool          `json:"reconcile_repair" structs:"reconcile_repair" mapstructure:"reconcile_repair"`
+	ReconcileDeleteUnknown bool          `json:"reconcile_delete_unknown" structs:"reconcile_delete_unknown" mapstructure:"reconcile_delete_unknown"`
+	// ReconcileSafetyBuffer is how long an account must have been unknown
+	// before reconciliation deletes it. Zero means the default.
+	ReconcileSafetyBuffer time.Duration `json:"reconcile_safety_buffer" structs:"reconcile_safety_buffer" mapstructure:"reconcile_safety_buffer"`
+
+	// RootPasswordGracePeriod is how long the previous root password is kept
+	// after a rotation, for the requests that still use it.
+	RootPasswordGracePeriod   time.Duration `json:"root_password_grace_period" structs:"root_password_grace_period" mapstructure:"root_password_grace_period"`
+	PreviousPassword          string        `json:"previous_password" structs:"-" mapstructure:"previous_password"`
+	PreviousPasswordExpiresAt time.Time     `json:"previous_password_expires_at" structs:"-" mapstructure:"previous_password_expires_at"`
+}
+
+// retryPolicy returns the retry policy configured for the instance.
+func (c *horizonConfig) retryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxRetries: c.MaxRetries,
+		MinBackoff: c.RetryMinBackoff,
+		MaxBackoff: c.RetryMaxBackoff,
+	}
+}
+
+// previousPassword returns the previous root password, if its grace window
+// is still open at now.
+func (c *horizonConfig) previousPassword(now time.Time) string {
+	if c.PreviousPassword == "" || !now.Before(c.PreviousPasswordExpiresAt) {
+		return ""
+	}
+	return c.PreviousPassword
+}
+
+// clearPreviousPassword drops the previous root password.
+func (c *horizonConfig) clearPreviousPassword() {
+	c.PreviousPassword = ""
+	c.PreviousPasswordExpiresAt = time.Time{}
+}
+
+// validate checks that the settings of the instance are consistent.
+func (c *horizonConfig) validate() error {
+	if c.HorizonEndpoint == "" {
+		return errors.New("Empty horizon endpoint")
+	}
+	if c.MaxRetries < 0 {
+		return errors.New("max_retries cannot be negative")
+	}
+	if c.RetryMaxBackoff != 0 && c.RetryMinBackoff > c.RetryMaxBackoff {
+		return errors.New("retry_min_backoff cannot be greater than retry_max_backoff")
+	}
+	if c.ReconcileDeleteUnknown && c.UsernamePrefix == "" {
+		return errors.New("reconcile_delete_unknown requires a username_prefix")
+	}
+	if c.RevocationMaxAttempts < 0 {
+		return errors.New("revocation_max_attempts cannot be negative")
+	}
+	if c.ReconcileSafetyBuffer < 0 {
+		return errors.New("reconcile_safety_buffer cannot be negative")
+	}
+	if c.RootPasswordGracePeriod < 0 {
+		return errors.New("root_password_grace_period cannot be negative")
+	}
+	return nil
+}
+
+// rootUsername returns the account the engine connects to the instance with.
+func (c *horizonConfig) rootUsername() string {
+	username, _ := c.ConnectionDetails["username"].(string)
+	return username
 }
 
 var (
@@ -47,6 +135,72 @@ func pathConfig(b *horizonBackend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: `Username policy to use when generating usernames.`,
 			},
+
+			"max_retries": {
+				Type:        framework.TypeInt,
+				Description: "Number of times a failed call to horizon is retried. Defaults to 3.",
+				Default:     defaultMaxRetries,
+			},
+
+			"retry_min_backoff": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Minimum delay between two attempts of a failed call to horizon.",
+			},
+
+			"retry_max_backoff": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Maximum delay between two attempts of a failed call to horizon.",
+			},
+
+			"request_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Timeout of a single call to horizon. Defaults to no timeout.",
+			},
+
+			"breaker_threshold": {
+				Type:        framework.TypeInt,
+				Description: "Number of consecutive failed calls after which horizon is considered unavailable. Defaults to 5.",
+			},
+
+			"breaker_cooldown": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time during which calls fail fast once horizon is considered unavailable. Defaults to 30s.",
+			},
+
+			"revocation_max_attempts": {
+				Type:        framework.TypeInt,
+				Description: "Number of times the revocation of an account that failed is retried from the revocation queue before it is given up. Defaults to 10.",
+			},
+
+			"username_prefix": {
+				Type:        framework.TypeString,
+				Description: "Prefix of the name of every account created by the engine.",
+			},
+
+			"reconcile_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Interval between two reconciliations of the managed accounts against horizon. Defaults to 0 (disabled).",
+			},
+
+			"reconcile_repair": {
+				Type:        framework.TypeBool,
+				Description: "Whether reconciliation assigns back the expected roles of managed accounts whose roles changed.",
+			},
+
+			"reconcile_delete_unknown": {
+				Type:        framework.TypeBool,
+				Description: "Whether reconciliation deletes the accounts matching username_prefix that the engine does not manage.",
+			},
+
+			"reconcile_safety_buffer": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time an account must have been found unknown, on an earlier reconciliation, before reconcile_delete_unknown deletes it. Defaults to 1h.",
+			},
+
+			"root_password_grace_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time during which the previous root password is still tried after a rotation. Defaults to 0 (disabled).",
+			},
 		},
 		ExistenceCheck: b.pathConfigExistenceCheck(),
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -68,6 +222,10 @@ func (b *horizonBackend) pathConfigWrite() framework.OperationFunc {
 			return logical.ErrorResponse(respErrEmptyInstance), nil
 		}
 
+		lock := b.instanceLock(instance)
+		lock.Lock()
+		defer lock.Unlock()
+
 		// Baseline
 		config := &horizonConfig{}
 
@@ -76,7 +234,7 @@ func (b *horizonBackend) pathConfigWrite() framework.OperationFunc {
 			return nil, fmt.Errorf("failed to read connection configuration: %w", err)
 		}
 		if entry != nil {
-			if err := entry.DecodeJSON(config); err != nil {
+			if config, err = decodeConfig(entry); err != nil {
 				return nil, err
 			}
 		}
@@ -86,9 +244,6 @@ func (b *horizonBackend) pathConfigWrite() framework.OperationFunc {
 		} else if req.Operation == logical.CreateOperation {
 			config.HorizonEndpoint = data.Get("horizon_endpoint").(string)
 		}
-		if config.HorizonEndpoint == "" {
-			return logical.ErrorResponse("Empty horizon endpoint"), nil
-		}
 
 		if rootRotationStatementsRaw, ok := data.GetOk("root_rotation_statements"); ok {
 			config.RootCredentialsRotateStatements = rootRotationStatementsRaw.([]string)
@@ -105,6 +260,62 @@ func (b *horizonBackend) pathConfigWrite() framework.OperationFunc {
 			config.UsernamePolicy = usernamePolicyRaw.(string)
 		}
 
+		if maxRetriesRaw, ok := data.GetOk("max_retries"); ok {
+			config.MaxRetries = maxRetriesRaw.(int)
+		} else if req.Operation == logical.CreateOperation {
+			config.MaxRetries = data.Get("max_retries").(int)
+		}
+
+		if minBackoffRaw, ok := data.GetOk("retry_min_backoff"); ok {
+			config.RetryMinBackoff = time.Duration(minBackoffRaw.(int)) * time.Second
+		}
+		if maxBackoffRaw, ok := data.GetOk("retry_max_backoff"); ok {
+			config.RetryMaxBackoff = time.Duration(maxBackoffRaw.(int)) * time.Second
+		}
+
+		if timeoutRaw, ok := data.GetOk("request_timeout"); ok {
+			config.RequestTimeout = time.Duration(timeoutRaw.(int)) * time.Second
+		}
+
+		if thresholdRaw, ok := data.GetOk("breaker_threshold"); ok {
+			config.BreakerThreshold = thresholdRaw.(int)
+		}
+		if cooldownRaw, ok := data.GetOk("breaker_cooldown"); ok {
+			config.BreakerCooldown = time.Duration(cooldownRaw.(int)) * time.Second
+		}
+
+		if maxAttemptsRaw, ok := data.GetOk("revocation_max_attempts"); ok {
+			config.RevocationMaxAttempts = maxAttemptsRaw.(int)
+		}
+
+		if prefixRaw, ok := data.GetOk("username_prefix"); ok {
+			config.UsernamePrefix = prefixRaw.(string)
+		}
+
+		if intervalRaw, ok := data.GetOk("reconcile_interval"); ok {
+			config.ReconcileInterval = time.Duration(intervalRaw.(int)) * time.Second
+		}
+		if repairRaw, ok := data.GetOk("reconcile_repair"); ok {
+			config.ReconcileRepair = repairRaw.(bool)
+		}
+		if deleteUnknownRaw, ok := data.GetOk("reconcile_delete_unknown"); ok {
+			config.ReconcileDeleteUnknown = deleteUnknownRaw.(bool)
+		}
+		if safetyBufferRaw, ok := data.GetOk("reconcile_safety_buffer"); ok {
+			config.ReconcileSafetyBuffer = time.Duration(safetyBufferRaw.(int)) * time.Second
+		}
+
+		if gracePeriodRaw, ok := data.GetOk("root_password_grace_period"); ok {
+			config.RootPasswordGracePeriod = time.Duration(gracePeriodRaw.(int)) * time.Second
+		}
+		if err := config.validate(); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if _, ok := data.Raw["password"]; ok {
+			// The previous password was the one of the former root account.
+			config.clearPreviousPassword()
+		}
+
 		// Remove these entries from the data before we store it keyed under
 		// ConnectionDetails.
 		delete(data.Raw, "instance")
@@ -112,6 +323,19 @@ func (b *horizonBackend) pathConfigWrite() framework.OperationFunc {
 		delete(data.Raw, "root_rotation_statements")
 		delete(data.Raw, "password_policy")
 		delete(data.Raw, "username_policy")
+		delete(data.Raw, "max_retries")
+		delete(data.Raw, "retry_min_backoff")
+		delete(data.Raw, "retry_max_backoff")
+		delete(data.Raw, "request_timeout")
+		delete(data.Raw, "breaker_threshold")
+		delete(data.Raw, "breaker_cooldown")
+		delete(data.Raw, "revocation_max_attempts")
+		delete(data.Raw, "username_prefix")
+		delete(data.Raw, "reconcile_interval")
+		delete(data.Raw, "reconcile_repair")
+		delete(data.Raw, "reconcile_delete_unknown")
+		delete(data.Raw, "reconcile_safety_buffer")
+		delete(data.Raw, "root_password_grace_period")
 
 		// If this is an update, take any new values, overwrite what was there
 		// before, and pass that in as the "new" set of values to the plugin,
@@ -131,6 +355,11 @@ func (b *horizonBackend) pathConfigWrite() framework.OperationFunc {
 		if err != nil {
 			return nil, err
 		}
+		b.resetInstance(instance)
+		// The last probe may be about another endpoint or account.
+		if err := req.Storage.Delete(ctx, statusProbePath+instance); err != nil {
+			return nil, fmt.Errorf("failed to delete instance status: %w", err)
+		}
 
 		resp := &logical.Response{}
 
@@ -157,16 +386,28 @@ func (b *horizonBackend) pathConfigRead() framework.OperationFunc {
 			return nil, nil
 		}
 
-		var config horizonConfig
-		if err := entry.DecodeJSON(&config); err != nil {
+		config, err := decodeConfig(entry)
+		if err != nil {
 			return nil, err
 		}
 
 		delete(config.ConnectionDetails, "password")
 		delete(config.ConnectionDetails, "private_key")
 
+		respData := structs.New(config).Map()
+		respData["retry_min_backoff"] = config.RetryMinBackoff.Seconds()
+		respData["retry_max_backoff"] = config.RetryMaxBackoff.Seconds()
+		respData["request_timeout"] = config.RequestTimeout.Seconds()
+		respData["breaker_cooldown"] = config.BreakerCooldown.Seconds()
+		respData["reconcile_interval"] = config.ReconcileInterval.Seconds()
+		respData["reconcile_safety_buffer"] = config.ReconcileSafetyBuffer.Seconds()
+		respData["root_password_grace_period"] = config.RootPasswordGracePeriod.Seconds()
+		if config.previousPassword(time.Now()) != "" {
+			respData["previous_password_expires_at"] = config.PreviousPasswordExpiresAt.Format(time.RFC3339)
+		}
+
 		return &logical.Response{
-			Data: structs.New(config).Map(),
+			Data: respData,
 		}, nil
 	}
 }
@@ -178,10 +419,20 @@ func (b *horizonBackend) pathConfigDelete() framework.OperationFunc {
 			return logical.ErrorResponse(respErrEmptyInstance), nil
 		}
 
+		lock := b.instanceLock(instance)
+		lock.Lock()
+		defer lock.Unlock()
+
 		err := req.Storage.Delete(ctx, fmt.Sprintf("config/%s", instance))
 		if err != nil {
 			return nil, fmt.Errorf("failed to delete connection configuration: %w", err)
 		}
+		for _, key := range []string{statusProbePath + instance, rootRotationPath + instance} {
+			if err := req.Storage.Delete(ctx, key); err != nil {
+				return nil, fmt.Errorf("failed to delete instance status: %w", err)
+			}
+		}
+		b.resetInstance(instance)
 
 		return nil, nil
 	}
@@ -198,6 +449,18 @@ func (b *horizonBackend) pathConfigExistenceCheck() framework.ExistenceFunc {
 	}
 }
 
+// decodeConfig decodes a stored configuration. Settings missing from it,
+// because it was written before they existed, take their default.
+func decodeConfig(entry *logical.StorageEntry) (*horizonConfig, error) {
+	config := &horizonConfig{
+		MaxRetries: defaultMaxRetries,
+	}
+	if err := entry.DecodeJSON(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
 func storeConfig(ctx context.Context, storage logical.Storage, instance string, config *horizonConfig) error {
 	entry, err := logical.StorageEntryJSON(fmt.Sprintf("config/%s", instance), config)
 	if err != nil {
@@ -6,6 +6,7 @@ import (
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -53,6 +54,39 @@ func TestConfig(t *testing.T) {
 	})
 }
 
+func TestConfigMaxRetriesUpgrade(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+	ctx := context.Background()
+
+	// A configuration stored before max_retries existed.
+	require.NoError(t, reqStorage.Put(ctx, &logical.StorageEntry{
+		Key:   "config/plugin-test",
+		Value: []byte(`{"horizon_endpoint":"` + horizon_endpoint + `","connection_details":{"username":"` + username + `"}}`),
+	}))
+
+	config, err := b.getConfig(ctx, reqStorage, "plugin-test")
+	require.NoError(t, err)
+	require.Equal(t, defaultMaxRetries, config.retryPolicy().MaxRetries)
+
+	require.NoError(t, testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+		"horizon_endpoint": "http://horizon:9000",
+	}))
+	config, err = b.getConfig(ctx, reqStorage, "plugin-test")
+	require.NoError(t, err)
+	require.Equal(t, defaultMaxRetries, config.MaxRetries)
+
+	// An explicit 0 disables retries.
+	require.NoError(t, testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+		"max_retries": 0,
+	}))
+	require.NoError(t, testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+		"horizon_endpoint": horizon_endpoint,
+	}))
+	config, err = b.getConfig(ctx, reqStorage, "plugin-test")
+	require.NoError(t, err)
+	require.Equal(t, 0, config.MaxRetries)
+}
+
 func testConfigCreate(t *testing.T, b logical.Backend, s logical.Storage, d map[string]interface{}) error {
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.CreateOperation,
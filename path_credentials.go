@@ -2,11 +2,13 @@ package horizonsecretsengine
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
+	"strings"
+	"time"
 
-	horizon "github.com/evertrust/horizon-go"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -20,10 +22,23 @@ func pathCredentials(b *horizonBackend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of the role.",
 			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "TTL of the credential. Defaults to the TTL of the role, and cannot exceed its max_ttl.",
+			},
+			"roles": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Horizon roles to assign, among the roles of the role. Defaults to all of them.",
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Check that a credential of the role can be issued, without creating the account.",
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation: b.pathCredsCreateRead(),
+			logical.ReadOperation:   b.pathCredsCreateRead(),
+			logical.UpdateOperation: b.pathCredsCreateRead(),
 		},
 
 		HelpSynopsis:    pathCredsCreateReadHelpSyn,
@@ -44,33 +59,88 @@ func (b *horizonBackend) pathCredsCreateRead() framework.OperationFunc {
 			return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", name)), nil
 		}
 
-		config, err := b.getConfig(ctx, req.Storage, role.Instance)
+		var warnings []string
+		ttl := role.TTL
+		if ttlRaw, ok := data.GetOk("ttl"); ok {
+			ttl = time.Duration(ttlRaw.(int)) * time.Second
+			if ttl <= 0 {
+				return logical.ErrorResponse("ttl must be positive"), nil
+			}
+			if role.MaxTTL > 0 && ttl > role.MaxTTL {
+				warnings = append(warnings, fmt.Sprintf("ttl is greater than the max_ttl of the role, capping it to %s", role.MaxTTL))
+				ttl = role.MaxTTL
+			}
+		}
+
+		allowedRoles, err := b.rolesForEntity(role, req.EntityID)
 		if err != nil {
 			return nil, err
 		}
+		if len(allowedRoles) == 0 && role.hasIdentityMapping() {
+			return logical.ErrorResponse("no horizon roles are mapped to the requesting entity"), nil
+		}
 
-		respData := make(map[string]interface{})
+		roles := allowedRoles
+		if rolesRaw, ok := data.GetOk("roles"); ok {
+			roles = rolesRaw.([]string)
+			if len(roles) == 0 {
+				return logical.ErrorResponse("roles cannot be empty"), nil
+			}
+			if !strutil.StrListSubset(allowedRoles, roles) {
+				return logical.ErrorResponse(fmt.Sprintf("roles must be a subset of the allowed roles: %s", strings.Join(allowedRoles, ", "))), nil
+			}
+		}
 
-		endpoint, err := url.Parse(config.HorizonEndpoint)
+		contact, err := b.contactForEntity(role, req.EntityID)
 		if err != nil {
 			return nil, err
 		}
-		h := new(horizon.Horizon)
-		h.Init(*endpoint, config.ConnectionDetails["username"].(string), config.ConnectionDetails["password"].(string), "", "")
 
-		ug, err := newUsernameGenerator(role.CredentialConfig)
+		logger := b.requestLogger(req, "creds", "role", name, "instance", role.Instance)
+
+		if data.Get("dry_run").(bool) {
+			resp, err := b.dryRunCredential(ctx, req, logger, role, &accountSpec{
+				Role:     name,
+				Instance: role.Instance,
+				Contact:  contact,
+				Roles:    roles,
+				TTL:      ttl,
+			})
+			if resp != nil {
+				resp.Warnings = warnings
+			}
+			return resp, err
+		}
+
+		lock := b.instanceLock(role.Instance)
+		lock.RLock()
+		defer lock.RUnlock()
+
+		config, err := b.getConfig(ctx, req.Storage, role.Instance)
 		if err != nil {
 			return nil, err
 		}
-		username, err := ug.generate(ctx, b)
+		client, err := b.newClient(role.Instance, config)
 		if err != nil {
 			return nil, err
 		}
 
-		acc, err := h.Local.Create(username, role.Contact)
+		err = b.acquireCredential(ctx, req.Storage, name, role.MaxActiveCredentials)
+		var maxErr *errMaxActiveCredentials
+		if errors.As(err, &maxErr) {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 		if err != nil {
 			return nil, err
 		}
+		issued := false
+		defer func() {
+			if !issued {
+				// The request context may be done already.
+				_ = b.releaseCredential(context.Background(), req.Storage, name)
+			}
+			emitOutcome(issued, roleLabels(role.Instance, name), "creds", "issue")
+		}()
 
 		pg, err := newPasswordGenerator(role.CredentialConfig)
 		if err != nil {
@@ -80,32 +150,144 @@ func (b *horizonBackend) pathCredsCreateRead() framework.OperationFunc {
 		if err != nil {
 			return nil, err
 		}
-		_, err = h.Local.SetPassword(acc, pwd)
-		if err != nil {
-			return nil, err
-		}
 
-		err = h.Local.AssignRoles(acc, role.Contact, role.Roles)
-		if err != nil {
-			return nil, err
+		spec := &accountSpec{
+			Role:     name,
+			Instance: role.Instance,
+			Password: pwd,
+			Contact:  contact,
+			Roles:    roles,
+			TTL:      ttl,
 		}
 
-		respData["username"] = acc.Identifier
-		respData["password"] = pwd
-
 		internal := map[string]interface{}{
-			"username": acc.Identifier,
 			"role":     name,
+			"instance": role.Instance,
+			// What was actually granted, for auditing.
+			"roles":   roles,
+			"ttl":     int64(ttl.Seconds()),
+			"contact": contact,
+		}
+
+		if role.AccountMode == accountModePerEntity {
+			if req.EntityID == "" {
+				return logical.ErrorResponse("the per_entity account mode requires a token bound to an identity entity"), nil
+			}
+			spec.Username = entityUsername(config.UsernamePrefix, name, req.EntityID)
+			client.logger = logger.With("account", spec.Username)
+			if err := b.issueEntityAccount(ctx, req, client, spec); err != nil {
+				logger.Error("failed to issue credential", "account", spec.Username, "error", redact(err.Error(), pwd))
+				return nil, err
+			}
+			internal["account_mode"] = accountModePerEntity
+			internal["entity_id"] = req.EntityID
+		} else {
+			ug, err := newUsernameGenerator(role.CredentialConfig)
+			if err != nil {
+				return nil, err
+			}
+			username, err := ug.generate(ctx, b)
+			if err != nil {
+				return nil, err
+			}
+			spec.Username = config.UsernamePrefix + username
+			client.logger = logger.With("account", spec.Username)
+			if err := b.createManagedAccount(ctx, req, client, spec); err != nil {
+				logger.Error("failed to issue credential", "account", spec.Username, "error", redact(err.Error(), pwd))
+				return nil, err
+			}
+		}
+		internal["username"] = spec.Username
+
+		respData := map[string]interface{}{
+			"username": spec.Username,
+			"password": pwd,
 		}
 
 		resp := b.Secret(SecretCredsType).Response(respData, internal)
-		resp.Secret.TTL = role.TTL
+		resp.Secret.TTL = ttl
 		resp.Secret.MaxTTL = role.MaxTTL
+		resp.Warnings = warnings
 
+		logger.Info("credential issued", "account", spec.Username, "ttl", ttl)
+		issued = true
 		return resp, nil
 	}
 }
 
+// accountSpec describes the Horizon account backing a credential.
+type accountSpec struct {
+	Role     string
+	Instance string
+	Username string
+	Password string
+	Contact  string
+	Roles    []string
+	TTL      time.Duration
+}
+
+// createManagedAccount creates the account in Horizon and records it in the
+// inventory. The account is deleted if anything fails along the way.
+func (b *horizonBackend) createManagedAccount(ctx context.Context, req *logical.Request, client *horizonClient, spec *accountSpec) error {
+	// Record the account before creating it, so that it gets deleted if
+	// the workflow is interrupted before the lease is handed out.
+	wal := &walAccount{
+		Instance: spec.Instance,
+		Username: spec.Username,
+	}
+	walID, err := framework.PutWAL(ctx, req.Storage, walTypeAccount, wal)
+	if err != nil {
+		return fmt.Errorf("failed to record account creation: %w", err)
+	}
+
+	acc, err := client.createAccount(ctx, spec.Username, spec.Contact)
+	if err != nil {
+		// The account under that name, if any, is not ours to delete. One
+		// created by a lost attempt is left to tidy.
+		client.logger.Warn("account creation failed", "error", redact(err.Error(), spec.Password))
+		_ = framework.DeleteWAL(ctx, req.Storage, walID)
+		return err
+	}
+	err = client.setPassword(ctx, acc, spec.Password)
+	if err == nil {
+		err = client.assignRoles(ctx, acc, spec.Contact, spec.Roles)
+	}
+	if err != nil {
+		client.logger.Warn("account setup failed, deleting the account", "error", redact(err.Error(), spec.Password))
+		b.rollbackWorkflow(req.Storage, walID, walTypeAccount, wal)
+		return err
+	}
+	client.logger.Debug("account created", "roles", spec.Roles)
+
+	now := time.Now()
+	managed := &managedAccount{
+		Instance:  spec.Instance,
+		Username:  acc.Identifier,
+		Role:      spec.Role,
+		Roles:     spec.Roles,
+		Contact:   spec.Contact,
+		RequestID: req.ID,
+		EntityID:  req.EntityID,
+		CreatedAt: now,
+
+		ClientTokenAccessor: req.ClientTokenAccessor,
+		ExpiresAt:           now.Add(spec.TTL),
+	}
+	if err := putManagedAccount(ctx, req.Storage, managed); err != nil {
+		b.rollbackWorkflow(req.Storage, walID, walTypeAccount, wal)
+		return err
+	}
+
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		_ = deleteManagedAccount(ctx, req.Storage, spec.Instance, acc.Identifier)
+		b.rollbackWorkflow(req.Storage, walID, walTypeAccount, wal)
+		return fmt.Errorf("failed to complete account creation: %w", err)
+	}
+
+	spec.Username = acc.Identifier
+	return nil
+}
+
 const pathCredsCreateReadHelpSyn = `
 Request horizon credentials for a certain role.
 `
@@ -114,4 +296,14 @@ const pathCredsCreateReadHelpDesc = `
 This path reads horizon credentials for a certain role. The
 horizon credentials will be generated on demand and will be automatically
 revoked when the lease is up.
+
+A shorter "ttl" than the one of the role can be requested, and is capped to
+its "max_ttl". A subset of the horizon roles of the role can be requested with
+"roles".
+
+With "dry_run", the issuance is checked step by step without creating the
+account: the configuration of the instance is resolved, the username and
+password are generated, the engine authenticates to horizon, and the roles
+and contact of the account are checked. The result of each step is reported,
+and no lease is created.
 `
@@ -2,13 +2,16 @@ package horizonsecretsengine
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"testing"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
 )
 
 // newAcceptanceTestEnv creates a test environment for credentials
@@ -53,3 +56,362 @@ func TestAcceptanceUserCred(t *testing.T) {
 	t.Run("read user token cred", acceptanceTestEnv.ReadUserToken)
 	t.Run("read user token cred", acceptanceTestEnv.ReadUserToken)
 }
+
+func TestCredsLifecycle(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+		"ttl":      testTTL,
+		"max_ttl":  testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	m.failNext(503)
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	require.False(t, resp.IsError())
+
+	accUsername := resp.Data["username"].(string)
+	require.NotNil(t, m.account(accUsername))
+	require.Equal(t, resp.Data["password"], m.account(accUsername).Password)
+	require.Equal(t, []string{"operator"}, m.principal(accUsername).Roles)
+
+	managed, err := getManagedAccount(ctx, s, "mock", accUsername)
+	require.NoError(t, err)
+	require.NotNil(t, managed)
+	require.Equal(t, "mock-role", managed.Role)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret:    resp.Secret,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.Nil(t, m.account(accUsername))
+
+	managed, err = getManagedAccount(ctx, s, "mock", accUsername)
+	require.NoError(t, err)
+	require.Nil(t, managed)
+}
+
+func TestCredsRollback(t *testing.T) {
+	b, s := getTestBackend(t)
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"max_retries": 0})
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+	})
+	require.NoError(t, err)
+
+	requireNothingLeft := func(t *testing.T) {
+		require.Empty(t, m.accountIdentifiers())
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+	}
+
+	t.Run("failed step deletes the account", func(t *testing.T) {
+		m.failRoute(http.MethodPost, principalsPath, http.StatusBadRequest)
+		defer m.failRoute(http.MethodPost, principalsPath, 0)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/mock-role",
+			Storage:   s,
+		})
+		require.Error(t, err)
+		requireNothingLeft(t)
+	})
+
+	t.Run("cancelled request leaves nothing behind", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/mock-role",
+			Storage:   s,
+		})
+		require.Error(t, err)
+		requireNothingLeft(t)
+	})
+
+	t.Run("failed creation leaves the existing account alone", func(t *testing.T) {
+		ctx := context.Background()
+		m.addAccount("taken")
+		defer m.deleteAccount("taken")
+
+		client, err := b.getClient(ctx, s, "mock")
+		require.NoError(t, err)
+		err = b.createManagedAccount(ctx, &logical.Request{Storage: s}, client, &accountSpec{
+			Role:     "mock-role",
+			Instance: "mock",
+			Username: "taken",
+			Password: "secret",
+			Contact:  "team@example.com",
+		})
+		require.Error(t, err)
+		require.NotNil(t, m.account("taken"))
+
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+	})
+}
+
+func TestCredsOverrides(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator", "auditor"},
+		"ttl":      testTTL,
+		"max_ttl":  testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	readCreds := func(t *testing.T, d map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/mock-role",
+			Storage:   s,
+			Data:      d,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("subset of roles and shorter ttl", func(t *testing.T) {
+		resp := readCreds(t, map[string]interface{}{"ttl": 60, "roles": "auditor"})
+		require.False(t, resp.IsError())
+		require.Equal(t, time.Minute, resp.Secret.TTL)
+		require.Equal(t, []string{"auditor"}, resp.Secret.InternalData["roles"])
+		require.Equal(t, int64(60), resp.Secret.InternalData["ttl"])
+		require.Equal(t, []string{"auditor"}, m.principal(resp.Data["username"].(string)).Roles)
+
+		renewed, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    resp.Secret,
+		})
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, renewed.Secret.TTL)
+	})
+
+	t.Run("ttl capped to max_ttl", func(t *testing.T) {
+		resp := readCreds(t, map[string]interface{}{"ttl": 2 * testMaxTTL})
+		require.False(t, resp.IsError())
+		require.Equal(t, time.Duration(testMaxTTL)*time.Second, resp.Secret.TTL)
+		require.NotEmpty(t, resp.Warnings)
+		require.Equal(t, []string{"operator", "auditor"}, resp.Secret.InternalData["roles"])
+	})
+
+	t.Run("roles outside the role", func(t *testing.T) {
+		resp := readCreds(t, map[string]interface{}{"roles": "admin"})
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("empty roles", func(t *testing.T) {
+		resp := readCreds(t, map[string]interface{}{"roles": ""})
+		require.True(t, resp.IsError())
+		require.Equal(t, "roles cannot be empty", resp.Error().Error())
+	})
+}
+
+func TestCredsRotate(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+	})
+	require.NoError(t, err)
+
+	creds, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+		EntityID:  "alice",
+	})
+	require.NoError(t, err)
+	accUsername := creds.Data["username"].(string)
+
+	rotate := func(entityID string, username string) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/mock-role/rotate",
+			Storage:   s,
+			EntityID:  entityID,
+			Data:      map[string]interface{}{"username": username},
+		})
+	}
+
+	_, err = rotate("bob", accUsername)
+	require.ErrorIs(t, err, logical.ErrPermissionDenied)
+
+	resp, err := rotate("alice", "unknown")
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	resp, err = rotate("alice", accUsername)
+	require.NoError(t, err)
+	require.Equal(t, accUsername, resp.Data["username"])
+	require.NotEqual(t, creds.Data["password"], resp.Data["password"])
+	require.Equal(t, resp.Data["password"], m.account(accUsername).Password)
+
+	managed, err := getManagedAccount(ctx, s, "mock", accUsername)
+	require.NoError(t, err)
+	require.Equal(t, 1, managed.PasswordRotations)
+	require.False(t, managed.PasswordRotatedAt.IsZero())
+
+	t.Run("tokens without an entity", func(t *testing.T) {
+		creds, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:           logical.ReadOperation,
+			Path:                "creds/mock-role",
+			Storage:             s,
+			ClientTokenAccessor: "accessor",
+		})
+		require.NoError(t, err)
+		accUsername := creds.Data["username"].(string)
+
+		rotateWith := func(accessor string) error {
+			_, err := b.HandleRequest(ctx, &logical.Request{
+				Operation:           logical.UpdateOperation,
+				Path:                "creds/mock-role/rotate",
+				Storage:             s,
+				ClientTokenAccessor: accessor,
+				Data:                map[string]interface{}{"username": accUsername},
+			})
+			return err
+		}
+		require.ErrorIs(t, rotateWith("other-accessor"), logical.ErrPermissionDenied)
+		require.ErrorIs(t, rotateWith(""), logical.ErrPermissionDenied)
+		require.NoError(t, rotateWith("accessor"))
+
+		// Credentials recorded without an accessor cannot be rotated.
+		managed, err := getManagedAccount(ctx, s, "mock", accUsername)
+		require.NoError(t, err)
+		managed.ClientTokenAccessor = ""
+		require.NoError(t, putManagedAccount(ctx, s, managed))
+		require.ErrorIs(t, rotateWith(""), logical.ErrPermissionDenied)
+	})
+}
+
+func TestCredsDryRun(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"username_prefix": "vault-",
+	})
+	m.addAccount(username)
+	m.setPassword(username, password)
+	m.defineRoles("operator", "auditor")
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance":               "mock",
+		"roles":                  []string{"operator", "administrator"},
+		"contact":                "team@example.com",
+		"max_active_credentials": 2,
+	})
+	require.NoError(t, err)
+
+	dryRun := func(t *testing.T, data map[string]interface{}) map[string]map[string]interface{} {
+		t.Helper()
+		data["dry_run"] = true
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/mock-role",
+			Data:      data,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.False(t, resp.IsError(), "unexpected error response: %v", resp)
+		require.Nil(t, resp.Secret)
+		require.NotContains(t, resp.Data, "password")
+
+		steps := make(map[string]map[string]interface{})
+		success := true
+		for _, step := range resp.Data["steps"].([]interface{}) {
+			step := step.(map[string]interface{})
+			steps[step["step"].(string)] = step
+			success = success && step["success"] == true
+		}
+		require.Len(t, steps, 7)
+		require.Equal(t, success, resp.Data["success"])
+		return steps
+	}
+
+	steps := dryRun(t, map[string]interface{}{})
+	require.Equal(t, true, steps["config"]["success"])
+	require.Equal(t, true, steps["active_credentials"]["success"])
+	require.Equal(t, true, steps["username"]["success"])
+	require.Contains(t, steps["username"]["detail"], "vault-")
+	require.Equal(t, true, steps["password"]["success"])
+	require.Equal(t, true, steps["authenticate"]["success"])
+	require.Equal(t, false, steps["roles"]["success"])
+	require.Equal(t, "unknown horizon roles: administrator", steps["roles"]["detail"])
+	require.Equal(t, true, steps["contact"]["success"])
+
+	steps = dryRun(t, map[string]interface{}{"roles": "operator"})
+	require.Equal(t, true, steps["roles"]["success"])
+
+	// Nothing was created, nor counted.
+	require.ElementsMatch(t, []string{username}, m.accountIdentifiers())
+	active, err := getActiveCredentials(ctx, s, "mock-role")
+	require.NoError(t, err)
+	require.Zero(t, active)
+	managed, err := listManagedAccounts(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Empty(t, managed)
+
+	t.Run("authentication failure", func(t *testing.T) {
+		m.setPassword(username, "changed-by-hand")
+		defer m.setPassword(username, password)
+
+		steps := dryRun(t, map[string]interface{}{"roles": "operator"})
+		require.Equal(t, false, steps["authenticate"]["success"])
+		require.Contains(t, steps["authenticate"]["detail"], "401")
+		require.Equal(t, true, steps["roles"]["skipped"])
+	})
+
+	for _, contact := range []string{"not an email", "Team <team@example.com>"} {
+		t.Run("invalid contact "+contact, func(t *testing.T) {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "roles/mock-role",
+				Data:      map[string]interface{}{"contact": contact},
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			require.Nil(t, resp)
+
+			steps := dryRun(t, map[string]interface{}{"roles": "operator"})
+			require.Equal(t, false, steps["contact"]["success"])
+		})
+	}
+}
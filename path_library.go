@@ -0,0 +1,500 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathLibrary(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "library/?$",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathLibraryList,
+			},
+
+			HelpSynopsis:    pathLibraryHelpSyn,
+			HelpDescription: pathLibraryHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set.",
+				},
+				"instance": {
+					Type:        framework.TypeString,
+					Description: "Instance of horizon the service accounts belong to.",
+				},
+				"service_account_names": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Identifiers of the horizon accounts of the set.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default time a service account is checked out for.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum time a service account can be checked out for.",
+				},
+				"disable_check_in_enforcement": {
+					Type:        framework.TypeBool,
+					Description: "Let anyone check in a service account, rather than only its borrower.",
+				},
+			},
+			ExistenceCheck: b.pathLibraryExistenceCheck,
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathLibraryRead,
+				logical.CreateOperation: b.pathLibraryWrite,
+				logical.UpdateOperation: b.pathLibraryWrite,
+				logical.DeleteOperation: b.pathLibraryDelete,
+			},
+
+			HelpSynopsis:    pathLibraryHelpSyn,
+			HelpDescription: pathLibraryHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/check-out$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time to check out the service account for. Defaults to the ttl of the set.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathLibraryCheckOut,
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathLibraryCheckOutHelpSyn,
+			HelpDescription: pathLibraryCheckOutHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/check-in$",
+			Fields:  libraryCheckInFields(),
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathLibraryCheckIn(false),
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathLibraryCheckInHelpSyn,
+			HelpDescription: pathLibraryCheckInHelpDesc,
+		},
+		{
+			Pattern: "library/manage/" + framework.GenericNameRegex("name") + "/check-in$",
+			Fields:  libraryCheckInFields(),
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathLibraryCheckIn(true),
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathLibraryManageCheckInHelpSyn,
+			HelpDescription: pathLibraryManageCheckInHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/status$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathLibraryStatus,
+			},
+
+			HelpSynopsis:    pathLibraryStatusHelpSyn,
+			HelpDescription: pathLibraryStatusHelpDesc,
+		},
+	}
+}
+
+func libraryCheckInFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeString,
+			Description: "Name of the set.",
+		},
+		"service_account_names": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Service accounts to check in. Defaults to the only one held by the caller.",
+		},
+	}
+}
+
+func (b *horizonBackend) pathLibraryExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	set, err := getLibrarySet(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return set != nil, nil
+}
+
+func (b *horizonBackend) pathLibraryList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, libraryPath)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *horizonBackend) pathLibraryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	set, err := getLibrarySet(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"instance":                     set.Instance,
+			"service_account_names":        set.ServiceAccountNames,
+			"ttl":                          set.TTL.Seconds(),
+			"max_ttl":                      set.MaxTTL.Seconds(),
+			"disable_check_in_enforcement": set.DisableCheckInEnforcement,
+		},
+	}, nil
+}
+
+func (b *horizonBackend) pathLibraryWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse(respErrEmptyName), nil
+	}
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		set = &librarySet{}
+	}
+
+	if instanceRaw, ok := data.GetOk("instance"); ok {
+		if set.Instance != "" && set.Instance != instanceRaw.(string) {
+			return logical.ErrorResponse("the instance of a set cannot be changed"), nil
+		}
+		set.Instance = instanceRaw.(string)
+	}
+	if set.Instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+	config, err := b.getConfig(ctx, req.Storage, set.Instance)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if namesRaw, ok := data.GetOk("service_account_names"); ok {
+		set.ServiceAccountNames = strutil.RemoveDuplicatesStable(strutil.RemoveEmpty(namesRaw.([]string)), false)
+	}
+	if len(set.ServiceAccountNames) == 0 {
+		return logical.ErrorResponse("service_account_names is required"), nil
+	}
+
+	if ttlRaw, ok := data.GetOk("ttl"); ok {
+		set.TTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+	if maxTTLRaw, ok := data.GetOk("max_ttl"); ok {
+		set.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	}
+	if set.MaxTTL != 0 && set.TTL > set.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+	if enforcementRaw, ok := data.GetOk("disable_check_in_enforcement"); ok {
+		set.DisableCheckInEnforcement = enforcementRaw.(bool)
+	}
+
+	for _, account := range set.ServiceAccountNames {
+		// Checking out an account rotates its password.
+		if account == config.rootUsername() {
+			return logical.ErrorResponse("service account %q is the root account of the instance", account), nil
+		}
+		managed, err := getManagedAccount(ctx, req.Storage, set.Instance, account)
+		if err != nil {
+			return nil, err
+		}
+		if managed != nil {
+			return logical.ErrorResponse("service account %q is managed by the engine", account), nil
+		}
+		other, err := librarySetOf(ctx, req.Storage, set.Instance, account, name)
+		if err != nil {
+			return nil, err
+		}
+		if other != "" {
+			return logical.ErrorResponse("service account %q already belongs to set %q", account, other), nil
+		}
+	}
+
+	checkOuts, err := libraryCheckOuts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	for account := range checkOuts {
+		if !strutil.StrListContains(set.ServiceAccountNames, account) {
+			return logical.ErrorResponse("service account %q is checked out and cannot be removed from the set", account), nil
+		}
+	}
+
+	if err := putLibrarySet(ctx, req.Storage, name, set); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *horizonBackend) pathLibraryDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	checkOuts, err := libraryCheckOuts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(checkOuts) > 0 {
+		return logical.ErrorResponse("service accounts of the set are checked out, check them in first"), nil
+	}
+
+	if err := req.Storage.Delete(ctx, libraryPath+name); err != nil {
+		return nil, fmt.Errorf("error deleting library set: %w", err)
+	}
+	return nil, nil
+}
+
+func (b *horizonBackend) pathLibraryCheckOut(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return logical.ErrorResponse(fmt.Sprintf("unknown set: %s", name)), nil
+	}
+
+	var warnings []string
+	ttl := set.TTL
+	if ttlRaw, ok := data.GetOk("ttl"); ok {
+		ttl = time.Duration(ttlRaw.(int)) * time.Second
+		if set.MaxTTL > 0 && ttl > set.MaxTTL {
+			warnings = append(warnings, fmt.Sprintf("ttl is greater than the max_ttl of the set, capping it to %s", set.MaxTTL))
+			ttl = set.MaxTTL
+		}
+	}
+
+	account, password, checkOut, err := b.checkOutLibraryAccount(ctx, req, name, set)
+	if errors.Is(err, errNoAccountAvailable) {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err != nil {
+		b.requestLogger(req, "library-check-out", "set", name, "instance", set.Instance).Error("failed to check out account", "error", err)
+		return nil, err
+	}
+	b.requestLogger(req, "library-check-out", "set", name, "instance", set.Instance, "account", account).
+		Info("account checked out", "check_out_id", checkOut.ID, "ttl", ttl)
+
+	resp := b.Secret(SecretLibraryType).Response(map[string]interface{}{
+		"service_account_name": account,
+		"password":             password,
+	}, map[string]interface{}{
+		"set":                  name,
+		"service_account_name": account,
+		"check_out_id":         checkOut.ID,
+	})
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = set.MaxTTL
+	resp.Warnings = warnings
+	return resp, nil
+}
+
+func (b *horizonBackend) pathLibraryCheckIn(force bool) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		name := data.Get("name").(string)
+		set, err := getLibrarySet(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if set == nil {
+			return logical.ErrorResponse(fmt.Sprintf("unknown set: %s", name)), nil
+		}
+
+		checkOuts, err := libraryCheckOuts(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		enforce := !force && !set.DisableCheckInEnforcement
+		held := func(checkOut *libraryCheckOut) bool {
+			if !enforce {
+				return true
+			}
+			if req.EntityID != "" {
+				return checkOut.BorrowerEntityID == req.EntityID
+			}
+			return checkOut.BorrowerClientTokenAccessor == req.ClientTokenAccessor
+		}
+
+		accounts := data.Get("service_account_names").([]string)
+		if len(accounts) == 0 {
+			for account, checkOut := range checkOuts {
+				if held(checkOut) {
+					accounts = append(accounts, account)
+				}
+			}
+			if len(accounts) > 1 {
+				return logical.ErrorResponse("more than one service account is checked out, service_account_names is required"), nil
+			}
+		}
+
+		for _, account := range accounts {
+			if !strutil.StrListContains(set.ServiceAccountNames, account) {
+				return logical.ErrorResponse("service account %q does not belong to the set", account), nil
+			}
+			if checkOut := checkOuts[account]; checkOut != nil && !held(checkOut) {
+				return logical.ErrorResponse("service account %q is checked out by someone else", account), nil
+			}
+		}
+
+		checkIns := make([]string, 0, len(accounts))
+		for _, account := range accounts {
+			checkOut := checkOuts[account]
+			if checkOut == nil {
+				continue
+			}
+			// Leave alone an account checked in and lent again meanwhile.
+			if err := b.checkInLibraryAccount(ctx, req.Storage, name, set, account, checkOut.ID); err != nil {
+				return nil, err
+			}
+			checkIns = append(checkIns, account)
+		}
+
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"check_ins": checkIns,
+			},
+		}, nil
+	}
+}
+
+func (b *horizonBackend) pathLibraryStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, nil
+	}
+
+	checkOuts, err := libraryCheckOuts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(map[string]interface{}, len(set.ServiceAccountNames))
+	for _, account := range set.ServiceAccountNames {
+		checkOut := checkOuts[account]
+		if checkOut == nil {
+			status[account] = map[string]interface{}{
+				"available": true,
+			}
+			continue
+		}
+		status[account] = map[string]interface{}{
+			"available":                      false,
+			"borrower_entity_id":             checkOut.BorrowerEntityID,
+			"borrower_client_token_accessor": checkOut.BorrowerClientTokenAccessor,
+			"checked_out_at":                 checkOut.CheckedOutAt.Format(time.RFC3339),
+		}
+	}
+
+	return &logical.Response{
+		Data: status,
+	}, nil
+}
+
+const pathLibraryHelpSyn = `
+Manage sets of existing horizon accounts that can be checked out.
+`
+
+const pathLibraryHelpDesc = `
+A library set is a pool of existing horizon accounts, such as automation
+accounts referenced by name by external systems, that cannot be created on
+demand. Each account is lent to one borrower at a time, with a freshly
+rotated password, and its password is rotated again when it is checked in.
+
+A service account can only belong to one set, and cannot be removed from its
+set while it is checked out. The root account of the instance and the
+accounts the engine manages for credentials cannot be service accounts.
+`
+
+const pathLibraryCheckOutHelpSyn = `
+Check out a service account of a library set.
+`
+
+const pathLibraryCheckOutHelpDesc = `
+This path lends the first available service account of the set, with a
+freshly rotated password. The account is checked in when its lease is
+revoked or expires.
+`
+
+const pathLibraryCheckInHelpSyn = `
+Check in service accounts of a library set.
+`
+
+const pathLibraryCheckInHelpDesc = `
+This path checks in the given service accounts, or the only one held by the
+caller, and rotates their password. Unless "disable_check_in_enforcement" is
+set on the set, only the borrower of an account can check it in.
+`
+
+const pathLibraryManageCheckInHelpSyn = `
+Check in service accounts of a library set, whoever holds them.
+`
+
+const pathLibraryManageCheckInHelpDesc = `
+This path checks in the given service accounts regardless of their borrower,
+and rotates their password. It is meant for operators.
+`
+
+const pathLibraryStatusHelpSyn = `
+Returns the check-out status of the service accounts of a library set.
+`
+
+const pathLibraryStatusHelpDesc = `
+This path returns, for each service account of the set, whether it is
+available, and otherwise who borrowed it and when.
+`
@@ -0,0 +1,131 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibrary(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+	m.addAccount("svc-1", "operator")
+	m.addAccount("svc-2", "operator")
+
+	request := func(t *testing.T, op logical.Operation, path string, entityID string, d map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   s,
+			EntityID:  entityID,
+			Data:      d,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := request(t, logical.CreateOperation, "library/automation", "", map[string]interface{}{
+		"instance":              "mock",
+		"service_account_names": "svc-1,svc-2",
+		"ttl":                   600,
+		"max_ttl":               3600,
+	})
+	require.Nil(t, resp)
+
+	resp = request(t, logical.CreateOperation, "library/other", "", map[string]interface{}{
+		"instance":              "mock",
+		"service_account_names": "svc-2",
+	})
+	require.True(t, resp.IsError())
+
+	t.Run("root account is rejected", func(t *testing.T) {
+		resp := request(t, logical.CreateOperation, "library/root", "", map[string]interface{}{
+			"instance":              "mock",
+			"service_account_names": username,
+		})
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "root account")
+	})
+
+	t.Run("managed account is rejected", func(t *testing.T) {
+		require.NoError(t, putManagedAccount(ctx, s, &managedAccount{Instance: "mock", Username: "vault-leased"}))
+		m.addAccount("vault-leased", "operator")
+
+		resp := request(t, logical.CreateOperation, "library/leased", "", map[string]interface{}{
+			"instance":              "mock",
+			"service_account_names": "vault-leased",
+		})
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "managed by the engine")
+	})
+
+	first := request(t, logical.UpdateOperation, "library/automation/check-out", "alice", nil)
+	require.False(t, first.IsError())
+	require.Equal(t, "svc-1", first.Data["service_account_name"])
+	require.Equal(t, first.Data["password"], m.account("svc-1").Password)
+
+	second := request(t, logical.UpdateOperation, "library/automation/check-out", "bob", nil)
+	require.Equal(t, "svc-2", second.Data["service_account_name"])
+
+	resp = request(t, logical.UpdateOperation, "library/automation/check-out", "carol", nil)
+	require.True(t, resp.IsError())
+
+	status := request(t, logical.ReadOperation, "library/automation/status", "", nil)
+	require.Equal(t, false, status.Data["svc-1"].(map[string]interface{})["available"])
+	require.Equal(t, "alice", status.Data["svc-1"].(map[string]interface{})["borrower_entity_id"])
+
+	t.Run("check-in is enforced", func(t *testing.T) {
+		resp := request(t, logical.UpdateOperation, "library/automation/check-in", "bob", map[string]interface{}{
+			"service_account_names": "svc-1",
+		})
+		require.True(t, resp.IsError())
+
+		resp = request(t, logical.UpdateOperation, "library/automation/check-in", "alice", nil)
+		require.Equal(t, []string{"svc-1"}, resp.Data["check_ins"])
+		require.NotEqual(t, first.Data["password"], m.account("svc-1").Password)
+	})
+
+	t.Run("stale lease does not check in the next borrower", func(t *testing.T) {
+		next := request(t, logical.UpdateOperation, "library/automation/check-out", "carol", nil)
+		require.Equal(t, "svc-1", next.Data["service_account_name"])
+
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    first.Secret,
+		})
+		require.NoError(t, err)
+		require.Equal(t, next.Data["password"], m.account("svc-1").Password)
+	})
+
+	t.Run("lease expiry checks in", func(t *testing.T) {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    second.Secret,
+		})
+		require.NoError(t, err)
+		require.NotEqual(t, second.Data["password"], m.account("svc-2").Password)
+
+		status := request(t, logical.ReadOperation, "library/automation/status", "", nil)
+		require.Equal(t, true, status.Data["svc-2"].(map[string]interface{})["available"])
+	})
+
+	t.Run("managed check-in", func(t *testing.T) {
+		resp := request(t, logical.DeleteOperation, "library/automation", "", nil)
+		require.True(t, resp.IsError())
+
+		resp = request(t, logical.UpdateOperation, "library/manage/automation/check-in", "", map[string]interface{}{
+			"service_account_names": "svc-1",
+		})
+		require.Equal(t, []string{"svc-1"}, resp.Data["check_ins"])
+
+		resp = request(t, logical.DeleteOperation, "library/automation", "", nil)
+		require.Nil(t, resp)
+	})
+}
@@ -0,0 +1,386 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	reconcileReportPath = "reconcile/"
+	// reconcileUnknownPath keeps, per instance, when each unknown account
+	// was first found.
+	reconcileUnknownPath = "reconcile-unknown/"
+
+	defaultReconcileSafetyBuffer = time.Hour
+)
+
+// reconcileReport is the outcome of the last reconciliation of an instance.
+type reconcileReport struct {
+	Instance    string    `json:"instance" structs:"instance"`
+	StartedAt   time.Time `json:"started_at" structs:"-"`
+	CompletedAt time.Time `json:"completed_at" structs:"-"`
+	// Missing lists the managed accounts that no longer exist in Horizon.
+	Missing []string `json:"missing" structs:"missing"`
+	// RolesChanged lists the managed accounts whose roles differ from the
+	// ones the engine assigned.
+	RolesChanged []string `json:"roles_changed" structs:"roles_changed"`
+	// Unknown lists the accounts matching the username prefix of the
+	// instance that the engine does not manage.
+	Unknown  []string `json:"unknown" structs:"unknown"`
+	Repaired []string `json:"repaired" structs:"repaired"`
+	Deleted  []string `json:"deleted" structs:"deleted"`
+	Errors   []string `json:"errors" structs:"errors"`
+}
+
+func pathReconcile(b *horizonBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: reconcileReportPath + framework.GenericNameRegex("instance"),
+		Fields: map[string]*framework.FieldSchema{
+			"instance": {
+				Type:        framework.TypeString,
+				Description: "Instance of horizon.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathReconcileRead,
+			logical.UpdateOperation: b.pathReconcileUpdate,
+		},
+
+		HelpSynopsis:    pathReconcileHelpSyn,
+		HelpDescription: pathReconcileHelpDesc,
+	}
+}
+
+func (b *horizonBackend) pathReconcileRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	report, err := getReconcileReport(ctx, req.Storage, instance)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: report.responseData(),
+	}, nil
+}
+
+func (b *horizonBackend) pathReconcileUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	lock := b.instanceLock(instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	config, err := b.getConfig(ctx, req.Storage, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := b.reconcile(ctx, req.Storage, instance, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: report.responseData(),
+	}, nil
+}
+
+func (r *reconcileReport) responseData() map[string]interface{} {
+	data := structs.New(r).Map()
+	data["started_at"] = r.StartedAt.Format(time.RFC3339)
+	data["completed_at"] = r.CompletedAt.Format(time.RFC3339)
+	return data
+}
+
+// reconcileSafetyBuffer returns how long an account of the instance must
+// have been found unknown before reconciliation deletes it.
+func (c *horizonConfig) reconcileSafetyBuffer() time.Duration {
+	if c.ReconcileSafetyBuffer == 0 {
+		return defaultReconcileSafetyBuffer
+	}
+	return c.ReconcileSafetyBuffer
+}
+
+// reconcile compares the inventory of an instance against Horizon, repairs
+// or deletes what the configuration allows, and stores the report.
+func (b *horizonBackend) reconcile(ctx context.Context, s logical.Storage, instance string, config *horizonConfig) (*reconcileReport, error) {
+	report := &reconcileReport{
+		Instance:  instance,
+		StartedAt: time.Now(),
+	}
+
+	client, err := b.newClient(instance, config)
+	if err != nil {
+		return nil, err
+	}
+
+	managed, err := listManagedAccounts(ctx, s, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(managed))
+	for _, acc := range managed {
+		known[acc.Username] = true
+		if acc.revoked() {
+			// Kept on purpose by its revocation mode.
+			continue
+		}
+
+		horizonAcc, err := client.getAccount(ctx, acc.Username)
+		if isNotFound(err) {
+			report.Missing = append(report.Missing, acc.Username)
+			continue
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", acc.Username, err))
+			continue
+		}
+
+		infos, err := client.getPrincipalInfos(ctx, acc.Username)
+		if err != nil && !isNotFound(err) {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", acc.Username, err))
+			continue
+		}
+		var roles []string
+		if infos != nil && err == nil {
+			roles = infos.Roles
+		}
+		if sameRoles(roles, acc.Roles) {
+			continue
+		}
+
+		report.RolesChanged = append(report.RolesChanged, acc.Username)
+		if config.ReconcileRepair {
+			if err := client.assignRoles(ctx, horizonAcc, acc.Contact, acc.Roles); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", acc.Username, err))
+				continue
+			}
+			report.Repaired = append(report.Repaired, acc.Username)
+		}
+	}
+
+	if config.UsernamePrefix != "" {
+		accounts, err := client.listAccounts(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("listing accounts: %s", err))
+		}
+		// The accounts of in-flight credential requests are not in the
+		// inventory yet.
+		pending, err := pendingAccounts(ctx, s, instance)
+		if err != nil {
+			return nil, err
+		}
+		firstSeen, err := getReconcileUnknown(ctx, s, instance)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]time.Time)
+
+		for _, acc := range accounts {
+			if !strings.HasPrefix(acc.Identifier, config.UsernamePrefix) || known[acc.Identifier] ||
+				pending[acc.Identifier] || acc.Identifier == config.rootUsername() {
+				continue
+			}
+			// Library service accounts are shared, not in the inventory.
+			set, err := librarySetOf(ctx, s, instance, acc.Identifier, "")
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", acc.Identifier, err))
+				continue
+			}
+			if set != "" {
+				continue
+			}
+
+			report.Unknown = append(report.Unknown, acc.Identifier)
+			since, ok := firstSeen[acc.Identifier]
+			if !ok {
+				since = report.StartedAt
+			}
+			// An account is only deleted when an earlier pass already found
+			// it unknown, at least the safety buffer ago.
+			if !config.ReconcileDeleteUnknown || !ok || report.StartedAt.Sub(since) < config.reconcileSafetyBuffer() {
+				seen[acc.Identifier] = since
+				continue
+			}
+			if err := client.deleteAccount(ctx, acc); err != nil && !isNotFound(err) {
+				seen[acc.Identifier] = since
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", acc.Identifier, err))
+				continue
+			}
+			report.Deleted = append(report.Deleted, acc.Identifier)
+		}
+
+		if err := putReconcileUnknown(ctx, s, instance, seen); err != nil {
+			return nil, err
+		}
+	}
+
+	report.CompletedAt = time.Now()
+	b.Logger().Info("reconciliation completed", "operation", "reconcile", "instance", instance,
+		"missing", len(report.Missing), "roles_changed", len(report.RolesChanged), "repaired", len(report.Repaired),
+		"unknown", len(report.Unknown), "deleted", len(report.Deleted), "errors", len(report.Errors))
+	if err := putReconcileReport(ctx, s, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// reconcileInstances reconciles every instance whose reconciliation is due.
+func (b *horizonBackend) reconcileInstances(ctx context.Context, s logical.Storage) error {
+	instances, err := s.List(ctx, horizonConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	for _, instance := range instances {
+		if err := b.reconcileIfDue(ctx, s, instance); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("instance %q: %w", instance, err))
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+func (b *horizonBackend) reconcileIfDue(ctx context.Context, s logical.Storage, instance string) error {
+	lock := b.instanceLock(instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	config, err := b.getConfig(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+	if config.ReconcileInterval <= 0 {
+		return nil
+	}
+
+	last, err := getReconcileReport(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+	if last != nil && time.Since(last.StartedAt) < config.ReconcileInterval {
+		return nil
+	}
+
+	_, err = b.reconcile(ctx, s, instance, config)
+	return err
+}
+
+func getReconcileReport(ctx context.Context, s logical.Storage, instance string) (*reconcileReport, error) {
+	entry, err := s.Get(ctx, reconcileReportPath+instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reconciliation report: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var report reconcileReport
+	if err := entry.DecodeJSON(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func putReconcileReport(ctx context.Context, s logical.Storage, report *reconcileReport) error {
+	entry, err := logical.StorageEntryJSON(reconcileReportPath+report.Instance, report)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save reconciliation report: %w", err)
+	}
+	return nil
+}
+
+func getReconcileUnknown(ctx context.Context, s logical.Storage, instance string) (map[string]time.Time, error) {
+	entry, err := s.Get(ctx, reconcileUnknownPath+instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unknown accounts: %w", err)
+	}
+
+	unknown := make(map[string]time.Time)
+	if entry == nil {
+		return unknown, nil
+	}
+	if err := entry.DecodeJSON(&unknown); err != nil {
+		return nil, err
+	}
+	return unknown, nil
+}
+
+func putReconcileUnknown(ctx context.Context, s logical.Storage, instance string, unknown map[string]time.Time) error {
+	if len(unknown) == 0 {
+		return s.Delete(ctx, reconcileUnknownPath+instance)
+	}
+
+	entry, err := logical.StorageEntryJSON(reconcileUnknownPath+instance, unknown)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save unknown accounts: %w", err)
+	}
+	return nil
+}
+
+// sameRoles reports whether both lists hold the same roles, in any order.
+func sameRoles(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const pathReconcileHelpSyn = `
+Reconcile the accounts managed by the engine against horizon.
+`
+
+const pathReconcileHelpDesc = `
+Reading this path returns the report of the last reconciliation of the
+instance. Writing to it runs a reconciliation right away.
+
+A reconciliation flags the managed accounts that no longer exist in horizon,
+the managed accounts whose roles changed, and the horizon accounts matching
+the "username_prefix" of the instance that the engine does not manage. With
+"reconcile_repair", changed roles are assigned back. With
+"reconcile_delete_unknown", unknown accounts are deleted once a later
+reconciliation still finds them unknown, at least "reconcile_safety_buffer"
+(1h by default) after the first one did. Accounts whose creation is still in
+progress are never reported as unknown.
+
+Reconciliation runs periodically when "reconcile_interval" is set on the
+instance configuration.
+`
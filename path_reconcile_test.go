@@ -0,0 +1,180 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"username_prefix":          "vault-",
+		"reconcile_repair":         true,
+		"reconcile_delete_unknown": true,
+		"reconcile_safety_buffer":  1,
+	})
+
+	for _, acc := range []*managedAccount{
+		{Instance: "mock", Username: "vault-ok", Roles: []string{"a", "b"}},
+		{Instance: "mock", Username: "vault-gone", Roles: []string{"a"}},
+		{Instance: "mock", Username: "vault-widened", Roles: []string{"a"}},
+	} {
+		require.NoError(t, putManagedAccount(ctx, s, acc))
+	}
+	m.addAccount("vault-ok", "b", "a")
+	m.addAccount("vault-widened", "a", "admin")
+	m.addAccount("vault-stray")
+	m.addAccount("someone-else")
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "reconcile/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"vault-gone"}, resp.Data["missing"])
+	require.Equal(t, []string{"vault-widened"}, resp.Data["roles_changed"])
+	require.Equal(t, []string{"vault-widened"}, resp.Data["repaired"])
+	require.Equal(t, []string{"vault-stray"}, resp.Data["unknown"])
+	require.Empty(t, resp.Data["deleted"])
+	require.Empty(t, resp.Data["errors"])
+
+	require.Equal(t, []string{"a"}, m.principal("vault-widened").Roles)
+	require.NotNil(t, m.account("vault-stray"))
+
+	// Unknown accounts are only deleted by a later pass, once the safety
+	// buffer is over.
+	require.NoError(t, putReconcileUnknown(ctx, s, "mock", map[string]time.Time{
+		"vault-stray": time.Now().Add(-time.Minute),
+	}))
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "reconcile/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"vault-stray"}, resp.Data["deleted"])
+	require.Nil(t, m.account("vault-stray"))
+	require.NotNil(t, m.account("someone-else"))
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "reconcile/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"vault-gone"}, resp.Data["missing"])
+}
+
+func TestReconcileLibraryAccounts(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"username_prefix":          "vault-",
+		"reconcile_delete_unknown": true,
+	})
+
+	require.NoError(t, putLibrarySet(ctx, s, "automation", &librarySet{
+		Instance:            "mock",
+		ServiceAccountNames: []string{"vault-svc"},
+	}))
+	m.addAccount("vault-svc", "operator")
+
+	config, err := b.getConfig(ctx, s, "mock")
+	require.NoError(t, err)
+	report, err := b.reconcile(ctx, s, "mock", config)
+	require.NoError(t, err)
+	require.Empty(t, report.Unknown)
+	require.Empty(t, report.Deleted)
+	require.NotNil(t, m.account("vault-svc"))
+}
+
+func TestReconcileUnknownGracePeriod(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"username_prefix":          "vault-",
+		"reconcile_delete_unknown": true,
+	})
+	m.addAccount("vault-stray")
+	m.addAccount("vault-creating")
+
+	// A credential request is still setting this account up.
+	_, err := framework.PutWAL(ctx, s, walTypeAccount, &walAccount{
+		Instance: "mock",
+		Username: "vault-creating",
+	})
+	require.NoError(t, err)
+
+	config, err := b.getConfig(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Equal(t, defaultReconcileSafetyBuffer, config.reconcileSafetyBuffer())
+
+	for i := 0; i < 2; i++ {
+		report, err := b.reconcile(ctx, s, "mock", config)
+		require.NoError(t, err)
+		require.Equal(t, []string{"vault-stray"}, report.Unknown)
+		require.Empty(t, report.Deleted)
+	}
+	require.NotNil(t, m.account("vault-stray"))
+
+	// Found unknown longer than the safety buffer ago.
+	require.NoError(t, putReconcileUnknown(ctx, s, "mock", map[string]time.Time{
+		"vault-stray": time.Now().Add(-2 * time.Hour),
+	}))
+	report, err := b.reconcile(ctx, s, "mock", config)
+	require.NoError(t, err)
+	require.Equal(t, []string{"vault-stray"}, report.Deleted)
+	require.Nil(t, m.account("vault-stray"))
+	require.NotNil(t, m.account("vault-creating"))
+
+	unknown, err := getReconcileUnknown(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Empty(t, unknown)
+}
+
+func TestReconcileSafetyBufferUpgrade(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"username_prefix": "vault-",
+	})
+	m.addAccount("vault-stray")
+
+	// A configuration stored before reconcile_safety_buffer existed.
+	config, err := b.getConfig(ctx, s, "mock")
+	require.NoError(t, err)
+	config.ReconcileSafetyBuffer = 0
+	require.NoError(t, storeConfig(ctx, s, "mock", config))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/mock",
+		Data:      map[string]interface{}{"reconcile_delete_unknown": true},
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "unexpected error response: %v", resp)
+
+	config, err = b.getConfig(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Equal(t, defaultReconcileSafetyBuffer, config.reconcileSafetyBuffer())
+
+	for i := 0; i < 2; i++ {
+		report, err := b.reconcile(ctx, s, "mock", config)
+		require.NoError(t, err)
+		require.Equal(t, []string{"vault-stray"}, report.Unknown)
+		require.Empty(t, report.Deleted)
+	}
+	require.NotNil(t, m.account("vault-stray"))
+}
@@ -0,0 +1,467 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	revocationQueuePath = "revocation-queue/"
+
+	revocationRetryMinBackoff = 1 * time.Minute
+	revocationRetryMaxBackoff = 1 * time.Hour
+
+	defaultRevocationMaxAttempts = 10
+
+	revocationStatePending = "pending"
+	revocationStateFailed  = "failed"
+)
+
+// revocationQueueEntry is an account whose revocation failed when its lease
+// was revoked. The periodic function retries it until it succeeds, fails
+// with an error that is not worth retrying, or runs out of attempts; the
+// entry is then kept as failed, for an operator to look at.
+type revocationQueueEntry struct {
+	ID       string `json:"id"`
+	Instance string `json:"instance"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	LeaseID  string `json:"lease_id"`
+	// EntityID is set for per-entity accounts, whose revocation is dropped
+	// if the entity is handed the account again in the meantime.
+	EntityID string `json:"entity_id"`
+	// RevocationMode and PurgeAfter are those of the role at revocation.
+	RevocationMode string        `json:"revocation_mode"`
+	PurgeAfter     time.Duration `json:"purge_after"`
+	QueuedAt       time.Time     `json:"queued_at"`
+	NextAttempt    time.Time     `json:"next_attempt"`
+	Attempts       int           `json:"attempts"`
+	LastError      string        `json:"last_error"`
+	FailedAt       time.Time     `json:"failed_at"`
+	// Released is set once the account no longer counts against its role,
+	// which happens when the entry is given up.
+	Released bool `json:"released"`
+}
+
+func (e *revocationQueueEntry) failed() bool {
+	return !e.FailedAt.IsZero()
+}
+
+func (e *revocationQueueEntry) state() string {
+	if e.failed() {
+		return revocationStateFailed
+	}
+	return revocationStatePending
+}
+
+// revocationMaxAttempts returns the number of times a queued revocation of
+// the instance is retried before it is given up.
+func (c *horizonConfig) revocationMaxAttempts() int {
+	if c.RevocationMaxAttempts == 0 {
+		return defaultRevocationMaxAttempts
+	}
+	return c.RevocationMaxAttempts
+}
+
+// isRevocationRetryable reports whether a revocation that failed with err is
+// worth retrying later. An open circuit breaker means Horizon was found
+// unavailable, which is what the queue is for.
+func isRevocationRetryable(err error) bool {
+	return isRetryable(err) || errors.Is(err, errCircuitOpen)
+}
+
+func pathRevocationQueue(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "revocation-queue/?$",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathRevocationQueueRead,
+			},
+
+			HelpSynopsis:    pathRevocationQueueHelpSyn,
+			HelpDescription: pathRevocationQueueHelpDesc,
+		},
+		{
+			Pattern: "revocation-queue/" + framework.GenericNameRegex("id"),
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "Identifier of the queue entry.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.DeleteOperation: b.pathRevocationQueueDelete,
+			},
+
+			HelpSynopsis:    pathRevocationQueueEntryHelpSyn,
+			HelpDescription: pathRevocationQueueEntryHelpDesc,
+		},
+		{
+			Pattern: "revocation-queue/" + framework.GenericNameRegex("id") + "/retry$",
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "Identifier of the queue entry.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.pathRevocationQueueRetry,
+			},
+
+			HelpSynopsis:    pathRevocationQueueRetryHelpSyn,
+			HelpDescription: pathRevocationQueueRetryHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathRevocationQueueRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := listRevocationQueue(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := make([]map[string]interface{}, 0, len(entries))
+	failed := 0
+	for _, entry := range entries {
+		entryData := map[string]interface{}{
+			"id":           entry.ID,
+			"instance":     entry.Instance,
+			"username":     entry.Username,
+			"role":         entry.Role,
+			"lease_id":     entry.LeaseID,
+			"mode":         entry.RevocationMode,
+			"state":        entry.state(),
+			"queued_at":    entry.QueuedAt.Format(time.RFC3339),
+			"next_attempt": entry.NextAttempt.Format(time.RFC3339),
+			"attempts":     entry.Attempts,
+			"last_error":   entry.LastError,
+		}
+		if entry.failed() {
+			failed++
+			entryData["next_attempt"] = nil
+			entryData["failed_at"] = entry.FailedAt.Format(time.RFC3339)
+		}
+		queued = append(queued, entryData)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"count":   len(queued),
+			"failed":  failed,
+			"entries": queued,
+		},
+	}, nil
+}
+
+// pathRevocationQueueDelete dismisses a queue entry, leaving its account in
+// horizon.
+func (b *horizonBackend) pathRevocationQueueDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	id := data.Get("id").(string)
+	lock := b.revocationQueueLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := getRevocationQueueEntry(ctx, req.Storage, id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if !entry.Released {
+		if err := b.releaseCredential(ctx, req.Storage, entry.Role); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.Storage.Delete(ctx, revocationQueuePath+id); err != nil {
+		return nil, fmt.Errorf("failed to delete revocation queue entry: %w", err)
+	}
+
+	b.Logger().Info("queued revocation dismissed", "operation", "revocation-queue", "instance", entry.Instance,
+		"account", entry.Username, "role", entry.Role, "lease_id", entry.LeaseID, "state", entry.state())
+	return nil, nil
+}
+
+// pathRevocationQueueRetry makes a queue entry due right away, with a fresh
+// set of attempts. A failed entry is queued again.
+func (b *horizonBackend) pathRevocationQueueRetry(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	id := data.Get("id").(string)
+	lock := b.revocationQueueLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := getRevocationQueueEntry(ctx, req.Storage, id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse("unknown revocation queue entry %q", id), nil
+	}
+
+	entry.FailedAt = time.Time{}
+	entry.Attempts = 0
+	entry.NextAttempt = time.Now()
+	if err := putRevocationQueueEntry(ctx, req.Storage, entry); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *horizonBackend) revocationQueueLock(id string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.revocationQueueLocks, id)
+}
+
+// queueRevocation records an account whose deletion failed, so that it is
+// retried in the background.
+func queueRevocation(ctx context.Context, s logical.Storage, entry *revocationQueueEntry, cause error) error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry.ID = id
+	entry.QueuedAt = now
+	entry.NextAttempt = now.Add(revocationRetryMinBackoff)
+	entry.LastError = cause.Error()
+
+	return putRevocationQueueEntry(ctx, s, entry)
+}
+
+func getRevocationQueueEntry(ctx context.Context, s logical.Storage, id string) (*revocationQueueEntry, error) {
+	storageEntry, err := s.Get(ctx, revocationQueuePath+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation queue entry: %w", err)
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	var entry revocationQueueEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func putRevocationQueueEntry(ctx context.Context, s logical.Storage, entry *revocationQueueEntry) error {
+	storageEntry, err := logical.StorageEntryJSON(revocationQueuePath+entry.ID, entry)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+
+	if err := s.Put(ctx, storageEntry); err != nil {
+		return fmt.Errorf("failed to save revocation queue entry: %w", err)
+	}
+	return nil
+}
+
+// listRevocationQueue returns every queued revocation, oldest first.
+func listRevocationQueue(ctx context.Context, s logical.Storage) ([]*revocationQueueEntry, error) {
+	ids, err := s.List(ctx, revocationQueuePath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*revocationQueueEntry, 0, len(ids))
+	for _, id := range ids {
+		storageEntry, err := s.Get(ctx, revocationQueuePath+id)
+		if err != nil {
+			return nil, err
+		}
+		if storageEntry == nil {
+			continue
+		}
+
+		var entry revocationQueueEntry
+		if err := storageEntry.DecodeJSON(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QueuedAt.Before(entries[j].QueuedAt)
+	})
+	return entries, nil
+}
+
+// processRevocationQueue retries the queued revocations that are due.
+func (b *horizonBackend) processRevocationQueue(ctx context.Context, s logical.Storage) error {
+	entries, err := listRevocationQueue(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	now := time.Now()
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if entry.failed() || now.Before(entry.NextAttempt) {
+			continue
+		}
+		if err := b.processRevocationQueueEntry(ctx, s, entry.ID, now); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// processRevocationQueueEntry retries a queued revocation. The entry is read
+// again under its lock, as it may have been dismissed or retried since it was
+// listed.
+func (b *horizonBackend) processRevocationQueueEntry(ctx context.Context, s logical.Storage, id string, now time.Time) error {
+	lock := b.revocationQueueLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := getRevocationQueueEntry(ctx, s, id)
+	if err != nil {
+		return err
+	}
+	if entry == nil || entry.failed() || now.Before(entry.NextAttempt) {
+		return nil
+	}
+
+	backoff := retryPolicy{
+		MinBackoff: revocationRetryMinBackoff,
+		MaxBackoff: revocationRetryMaxBackoff,
+	}
+
+	var errs *multierror.Error
+	logger := b.Logger().With("operation", "revocation-queue", "instance", entry.Instance, "account", entry.Username, "role", entry.Role, "lease_id", entry.LeaseID)
+	err = b.retryRevocation(ctx, s, entry)
+	if err == nil {
+		logger.Info("queued revocation completed", "attempts", entry.Attempts+1)
+		if !entry.Released {
+			if err := b.releaseCredential(ctx, s, entry.Role); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		if err := s.Delete(ctx, revocationQueuePath+entry.ID); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return errs.ErrorOrNil()
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	maxAttempts := defaultRevocationMaxAttempts
+	if config, configErr := b.getConfig(ctx, s, entry.Instance); configErr == nil {
+		maxAttempts = config.revocationMaxAttempts()
+	}
+	if !isRevocationRetryable(err) || entry.Attempts >= maxAttempts {
+		// The lease is gone, so the account no longer counts against the
+		// role; it is left in horizon.
+		entry.FailedAt = now
+		logger.Error("queued revocation given up", "attempts", entry.Attempts, "error", err)
+		if !entry.Released {
+			if err := b.releaseCredential(ctx, s, entry.Role); err != nil {
+				errs = multierror.Append(errs, err)
+			} else {
+				entry.Released = true
+			}
+		}
+	} else {
+		entry.NextAttempt = now.Add(backoff.backoff(entry.Attempts))
+		logger.Warn("queued revocation failed", "attempts", entry.Attempts, "next_attempt", entry.NextAttempt, "error", err)
+	}
+	if err := putRevocationQueueEntry(ctx, s, entry); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return errs.ErrorOrNil()
+}
+
+// retryRevocation revokes the account of a queue entry. The revocation of a
+// per-entity account that was handed out again since is dropped.
+func (b *horizonBackend) retryRevocation(ctx context.Context, s logical.Storage, entry *revocationQueueEntry) error {
+	instanceLock := b.instanceLock(entry.Instance)
+	instanceLock.RLock()
+	defer instanceLock.RUnlock()
+
+	if entry.EntityID != "" {
+		lock := b.entityLock(entry.Role, entry.EntityID)
+		lock.Lock()
+		defer lock.Unlock()
+
+		inUse, err := entityAccountInUse(ctx, s, entry.Role, entry.EntityID)
+		if err != nil || inUse {
+			return err
+		}
+	}
+
+	return b.revokeAccount(ctx, s, entry.Instance, entry.Username, entry.RevocationMode, entry.PurgeAfter)
+}
+
+// deleteHorizonAccount deletes an account from an instance. An account that
+// no longer exists is not an error.
+func (b *horizonBackend) deleteHorizonAccount(ctx context.Context, s logical.Storage, instance string, username string) error {
+	client, err := b.getClient(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+
+	acc, err := client.getAccount(ctx, username)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = client.deleteAccount(ctx, acc)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+const pathRevocationQueueHelpSyn = `
+List the revocations waiting to be retried.
+`
+
+const pathRevocationQueueHelpDesc = `
+When an account cannot be deleted from horizon as its lease is revoked
+because horizon cannot be reached, the lease is still revoked and the account
+is queued here. Other failures are returned to Vault. The queue is processed
+periodically, backing off between attempts.
+
+An entry is given up after "revocation_max_attempts" attempts (10 by default,
+set on the configuration of the instance), or as soon as an attempt fails
+with an error that is not worth retrying. It is then kept in the "failed"
+state and the account is left in horizon, until the entry is dismissed or
+retried.
+`
+
+const pathRevocationQueueEntryHelpSyn = `
+Dismiss a queued revocation.
+`
+
+const pathRevocationQueueEntryHelpDesc = `
+Deleting an entry of the revocation queue stops its retries, such as once
+its account has been removed from horizon by hand. The account itself is left
+in horizon.
+`
+
+const pathRevocationQueueRetryHelpSyn = `
+Retry a queued revocation.
+`
+
+const pathRevocationQueueRetryHelpDesc = `
+This path makes an entry of the revocation queue due right away, with a fresh
+set of "revocation_max_attempts" attempts. A failed entry is queued again,
+such as once horizon has been fixed. The entry is retried by the next run of
+the periodic function.
+`
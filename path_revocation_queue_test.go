@@ -0,0 +1,215 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationQueue(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"max_retries": 0})
+	m.addAccount("leftover")
+
+	secret := &logical.Secret{
+		LeaseOptions: logical.LeaseOptions{TTL: time.Hour},
+		InternalData: map[string]interface{}{
+			"secret_type": SecretCredsType,
+			"username":    "leftover",
+			"role":        "mock-role",
+			"instance":    "mock",
+		},
+		LeaseID: "horizon/creds/mock-role/lease",
+	}
+
+	m.failRoute(http.MethodGet, localsPath+"/leftover", http.StatusServiceUnavailable)
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret:    secret,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.NotNil(t, m.account("leftover"))
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "revocation-queue",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.Data["count"])
+	pending := resp.Data["entries"].([]map[string]interface{})
+	require.Equal(t, "leftover", pending[0]["username"])
+	require.Equal(t, secret.LeaseID, pending[0]["lease_id"])
+
+	// Not due yet.
+	m.failRoute(http.MethodGet, localsPath+"/leftover", 0)
+	require.NoError(t, b.processRevocationQueue(ctx, s))
+	require.NotNil(t, m.account("leftover"))
+
+	entries, err := listRevocationQueue(ctx, s)
+	require.NoError(t, err)
+	entries[0].NextAttempt = time.Now().Add(-time.Second)
+	require.NoError(t, putRevocationQueueEntry(ctx, s, entries[0]))
+
+	require.NoError(t, b.processRevocationQueue(ctx, s))
+	require.Nil(t, m.account("leftover"))
+
+	entries, err = listRevocationQueue(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestRevocationQueueGivesUp(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"max_retries":             0,
+		"revocation_max_attempts": 2,
+	})
+	m.addAccount("leftover")
+
+	revoke := func(t *testing.T) error {
+		t.Helper()
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"secret_type": SecretCredsType,
+					"username":    "leftover",
+					"role":        "mock-role",
+					"instance":    "mock",
+				},
+				LeaseID: "horizon/creds/mock-role/lease",
+			},
+		})
+		return err
+	}
+	processDue := func(t *testing.T) {
+		t.Helper()
+		entries, err := listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			entry.NextAttempt = time.Now().Add(-time.Second)
+			require.NoError(t, putRevocationQueueEntry(ctx, s, entry))
+		}
+		require.NoError(t, b.processRevocationQueue(ctx, s))
+	}
+
+	t.Run("errors not worth retrying are not queued", func(t *testing.T) {
+		m.failRoute(http.MethodDelete, localsPath+"/leftover", http.StatusForbidden)
+		defer m.failRoute(http.MethodDelete, localsPath+"/leftover", 0)
+
+		require.Error(t, revoke(t))
+		entries, err := listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("exhausted entries are kept as failed", func(t *testing.T) {
+		m.failRoute(http.MethodGet, localsPath+"/leftover", http.StatusServiceUnavailable)
+		defer m.failRoute(http.MethodGet, localsPath+"/leftover", 0)
+
+		require.NoError(t, revoke(t))
+		processDue(t)
+		entries, err := listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, revocationStatePending, entries[0].state())
+
+		processDue(t)
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "revocation-queue",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, resp.Data["failed"])
+		entry := resp.Data["entries"].([]map[string]interface{})[0]
+		require.Equal(t, revocationStateFailed, entry["state"])
+		require.Equal(t, 2, entry["attempts"])
+		require.NotEmpty(t, entry["failed_at"])
+
+		// Failed entries are no longer retried.
+		calls := m.callCount()
+		processDue(t)
+		require.Equal(t, calls, m.callCount())
+		require.NotNil(t, m.account("leftover"))
+	})
+
+	t.Run("failed entries can be retried", func(t *testing.T) {
+		entries, err := listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		// The entry was released when it was given up.
+		require.NoError(t, putActiveCredentials(ctx, s, "mock-role", 2))
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "revocation-queue/" + entries[0].ID + "/retry",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		entry, err := getRevocationQueueEntry(ctx, s, entries[0].ID)
+		require.NoError(t, err)
+		require.Equal(t, revocationStatePending, entry.state())
+		require.Zero(t, entry.Attempts)
+
+		require.NoError(t, b.processRevocationQueue(ctx, s))
+		require.Nil(t, m.account("leftover"))
+		entries, err = listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		count, err := getActiveCredentials(ctx, s, "mock-role")
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+	})
+
+	t.Run("entries can be dismissed", func(t *testing.T) {
+		m.addAccount("leftover")
+		m.failRoute(http.MethodGet, localsPath+"/leftover", http.StatusServiceUnavailable)
+		defer m.failRoute(http.MethodGet, localsPath+"/leftover", 0)
+		require.NoError(t, revoke(t))
+
+		entries, err := listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		id := entries[0].ID
+
+		// A pending entry still counts against its role.
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "revocation-queue/" + id,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		entries, err = listRevocationQueue(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		count, err := getActiveCredentials(ctx, s, "mock-role")
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		require.NotNil(t, m.account("leftover"))
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "revocation-queue/" + id + "/retry",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
@@ -0,0 +1,161 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathRevoke(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "revoke-role/" + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the role.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathRevokeRoleUpdate,
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathRevokeRoleHelpSyn,
+			HelpDescription: pathRevokeRoleHelpDesc,
+		},
+		{
+			Pattern: "revoke-instance/" + framework.GenericNameRegex("instance"),
+			Fields: map[string]*framework.FieldSchema{
+				"instance": {
+					Type:        framework.TypeString,
+					Description: "Instance of horizon.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathRevokeInstanceUpdate,
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathRevokeInstanceHelpSyn,
+			HelpDescription: pathRevokeInstanceHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathRevokeRoleUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse(respErrEmptyName), nil
+	}
+
+	// The role may already be gone, so look for its accounts everywhere.
+	instances, err := req.Storage.List(ctx, managedAccountsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []*managedAccount
+	for _, instance := range instances {
+		managed, err := listManagedAccounts(ctx, req.Storage, strings.TrimSuffix(instance, "/"))
+		if err != nil {
+			return nil, err
+		}
+		for _, acc := range managed {
+			if acc.Role == name {
+				accounts = append(accounts, acc)
+			}
+		}
+	}
+
+	return b.revokeManagedAccounts(ctx, req.Storage, accounts), nil
+}
+
+func (b *horizonBackend) pathRevokeInstanceUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	accounts, err := listManagedAccounts(ctx, req.Storage, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.revokeManagedAccounts(ctx, req.Storage, accounts), nil
+}
+
+// revokeManagedAccounts deletes the given accounts from Horizon and drops
+// them from the inventory, reporting the outcome for each account. Accounts
+// already gone from Horizon count as revoked, so that it is safe to run again
+// after a partial failure.
+func (b *horizonBackend) revokeManagedAccounts(ctx context.Context, s logical.Storage, accounts []*managedAccount) *logical.Response {
+	results := make([]map[string]interface{}, 0, len(accounts))
+	revoked, failed := 0, 0
+	for _, acc := range accounts {
+		result := map[string]interface{}{
+			"instance": acc.Instance,
+			"username": acc.Username,
+			"role":     acc.Role,
+		}
+
+		err := b.revokeAccountLocked(ctx, s, acc.Instance, acc.Username, revocationModeDelete, 0)
+		if err != nil {
+			failed++
+			result["status"] = "failed"
+			result["error"] = err.Error()
+		} else {
+			revoked++
+			result["status"] = "revoked"
+		}
+		results = append(results, result)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"revoked": revoked,
+			"failed":  failed,
+			"results": results,
+		},
+	}
+	if failed > 0 {
+		resp.AddWarning("Some accounts could not be revoked. The operation can safely be run again.")
+	}
+	return resp
+}
+
+const pathRevokeRoleHelpSyn = `
+Delete from horizon every account issued from a role.
+`
+
+const pathRevokeRoleHelpDesc = `
+This path deletes from horizon every managed account that was issued from the
+given role, and reports the outcome for each of them. Accounts already gone
+from horizon are reported as revoked, so the operation can safely be run
+again.
+
+This does not revoke the Vault leases of the credentials, which can be done
+with "vault lease revoke -prefix <mount>/creds/<role>".
+`
+
+const pathRevokeInstanceHelpSyn = `
+Delete from horizon every account managed on an instance.
+`
+
+const pathRevokeInstanceHelpDesc = `
+This path deletes from horizon every managed account of the given instance,
+and reports the outcome for each of them. Accounts already gone from horizon
+are reported as revoked, so the operation can safely be run again.
+
+This does not revoke the Vault leases of the credentials.
+`
@@ -0,0 +1,64 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokeRole(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"max_retries": 0})
+
+	for _, acc := range []*managedAccount{
+		{Instance: "mock", Username: "vault-a", Role: "broad"},
+		{Instance: "mock", Username: "vault-b", Role: "broad"},
+		{Instance: "mock", Username: "vault-c", Role: "narrow"},
+	} {
+		require.NoError(t, putManagedAccount(ctx, s, acc))
+		m.addAccount(acc.Username)
+	}
+
+	revokeRole := func() *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "revoke-role/broad",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	m.failRoute(http.MethodDelete, localsPath+"/vault-b", http.StatusServiceUnavailable)
+	resp := revokeRole()
+	require.Equal(t, 1, resp.Data["revoked"])
+	require.Equal(t, 1, resp.Data["failed"])
+	require.Nil(t, m.account("vault-a"))
+	require.NotNil(t, m.account("vault-b"))
+
+	// Safe to run again once horizon is back.
+	m.failRoute(http.MethodDelete, localsPath+"/vault-b", 0)
+	resp = revokeRole()
+	require.Equal(t, 1, resp.Data["revoked"])
+	require.Equal(t, 0, resp.Data["failed"])
+	require.Nil(t, m.account("vault-b"))
+	require.NotNil(t, m.account("vault-c"))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "revoke-instance/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.Data["revoked"])
+	require.Empty(t, m.accountIdentifiers())
+
+	accounts, err := listManagedAccounts(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Empty(t, accounts)
+}
@@ -0,0 +1,356 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// roleHistoryPath keeps the revisions of each role, under
+	// role-history/<name>/<version>. They are not under the path of the
+	// role, which would list them along with the roles.
+	roleHistoryPath = "role-history/"
+
+	defaultRoleHistoryRetention = 10
+
+	roleOperationCreate   = "create"
+	roleOperationUpdate   = "update"
+	roleOperationDelete   = "delete"
+	roleOperationRollback = "rollback"
+	roleOperationImport   = "import"
+)
+
+// roleRevision records a write of a role: who made it, when, and what it
+// changed. Revisions are never updated, only pruned once they are beyond the
+// retention of the role.
+type roleRevision struct {
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	EntityID    string    `json:"entity_id"`
+	DisplayName string    `json:"display_name"`
+	Operation   string    `json:"operation"`
+	// Changes lists the settings changed by an update or a rollback.
+	Changes      []string `json:"changes"`
+	RolledBackTo int      `json:"rolled_back_to,omitempty"`
+	// Role is the role as written, nil if it was deleted.
+	Role *horizonRoleEntry `json:"role"`
+}
+
+// historyRetention returns the number of revisions of the role kept in its
+// history.
+func (r *horizonRoleEntry) historyRetention() int {
+	if r.HistoryRetention == 0 {
+		return defaultRoleHistoryRetention
+	}
+	return r.HistoryRetention
+}
+
+func pathRoleHistory(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + "/history/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the role.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRoleHistoryList,
+			},
+
+			HelpSynopsis:    pathRoleHistoryHelpSyn,
+			HelpDescription: pathRoleHistoryHelpDesc,
+		},
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + `/history/(?P<version>\d+)$`,
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the role.",
+				},
+				"version": {
+					Type:        framework.TypeInt,
+					Description: "Version of the revision.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathRoleHistoryRead,
+			},
+
+			HelpSynopsis:    pathRoleHistoryHelpSyn,
+			HelpDescription: pathRoleHistoryHelpDesc,
+		},
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + "/rollback$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the role.",
+				},
+				"version": {
+					Type:        framework.TypeInt,
+					Description: "Version of the revision to roll the role back to.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathRoleRollback,
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathRoleRollbackHelpSyn,
+			HelpDescription: pathRoleRollbackHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathRoleHistoryList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	versions, err := listRoleRevisions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(versions))
+	keyInfo := make(map[string]interface{}, len(versions))
+	for _, version := range versions {
+		rev, err := getRoleRevision(ctx, req.Storage, name, version)
+		if err != nil {
+			return nil, err
+		}
+		if rev == nil {
+			continue
+		}
+		key := strconv.Itoa(version)
+		keys = append(keys, key)
+		keyInfo[key] = map[string]interface{}{
+			"created_at":   rev.CreatedAt.Format(time.RFC3339),
+			"entity_id":    rev.EntityID,
+			"display_name": rev.DisplayName,
+			"operation":    rev.Operation,
+			"changes":      rev.Changes,
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *horizonBackend) pathRoleHistoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	rev, err := getRoleRevision(ctx, req.Storage, name, data.Get("version").(int))
+	if err != nil {
+		return nil, err
+	}
+	if rev == nil {
+		return nil, nil
+	}
+
+	respData := map[string]interface{}{
+		"version":      rev.Version,
+		"created_at":   rev.CreatedAt.Format(time.RFC3339),
+		"entity_id":    rev.EntityID,
+		"display_name": rev.DisplayName,
+		"operation":    rev.Operation,
+		"changes":      rev.Changes,
+	}
+	if rev.RolledBackTo != 0 {
+		respData["rolled_back_to"] = rev.RolledBackTo
+	}
+	if rev.Role != nil {
+		respData["role"] = roleResponseData(rev.Role)
+	}
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *horizonBackend) pathRoleRollback(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	version, ok := data.GetOk("version")
+	if !ok {
+		return logical.ErrorResponse("version is required"), nil
+	}
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	rev, err := getRoleRevision(ctx, req.Storage, name, version.(int))
+	if err != nil {
+		return nil, err
+	}
+	if rev == nil {
+		return logical.ErrorResponse("unknown revision %d of role %q", version, name), nil
+	}
+	if rev.Role == nil {
+		return logical.ErrorResponse("revision %d deleted role %q", version, name), nil
+	}
+
+	previous, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	role := rev.Role
+	if previous != nil {
+		// Rolling back must not drop the revisions kept since.
+		role.HistoryRetention = previous.HistoryRetention
+	}
+	if err := role.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := setRole(ctx, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+	err = b.recordRoleRevision(ctx, req, name, previous, &roleRevision{
+		Operation:    roleOperationRollback,
+		RolledBackTo: rev.Version,
+		Role:         role,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.requestLogger(req, "rollback-role", "role", name).Info("role rolled back", "version", rev.Version)
+	return nil, nil
+}
+
+// recordRoleRevision completes rev with the next version of the role, the
+// requester and the changes from previous, which is nil if the role did not
+// exist, then stores it. The revisions beyond the retention of the role are
+// pruned. The caller holds the lock of the role.
+func (b *horizonBackend) recordRoleRevision(ctx context.Context, req *logical.Request, name string, previous *horizonRoleEntry, rev *roleRevision) error {
+	versions, err := listRoleRevisions(ctx, req.Storage, name)
+	if err != nil {
+		return err
+	}
+
+	rev.Version = 1
+	if len(versions) > 0 {
+		rev.Version = versions[len(versions)-1] + 1
+	}
+	rev.CreatedAt = time.Now()
+	rev.EntityID = req.EntityID
+	rev.DisplayName = req.DisplayName
+	if previous != nil && rev.Role != nil {
+		rev.Changes, err = diffRoles(previous, rev.Role)
+		if err != nil {
+			return err
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s%s/%d", roleHistoryPath, name, rev.Version), rev)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save role revision: %w", err)
+	}
+
+	retention := defaultRoleHistoryRetention
+	switch {
+	case rev.Role != nil:
+		retention = rev.Role.historyRetention()
+	case previous != nil:
+		retention = previous.historyRetention()
+	}
+	versions = append(versions, rev.Version)
+	for len(versions) > retention {
+		if err := req.Storage.Delete(ctx, fmt.Sprintf("%s%s/%d", roleHistoryPath, name, versions[0])); err != nil {
+			return fmt.Errorf("failed to delete role revision: %w", err)
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// diffRoles lists the settings that differ between two roles.
+func diffRoles(before *horizonRoleEntry, after *horizonRoleEntry) ([]string, error) {
+	beforeData, err := toResponseData(before)
+	if err != nil {
+		return nil, err
+	}
+	afterData, err := toResponseData(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := diffMaps("", beforeData, afterData)
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// listRoleRevisions returns the versions of the revisions of a role, oldest
+// first.
+func listRoleRevisions(ctx context.Context, s logical.Storage, name string) ([]int, error) {
+	keys, err := s.List(ctx, roleHistoryPath+name+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list role revisions: %w", err)
+	}
+
+	versions := make([]int, 0, len(keys))
+	for _, key := range keys {
+		version, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func getRoleRevision(ctx context.Context, s logical.Storage, name string, version int) (*roleRevision, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s%s/%d", roleHistoryPath, name, version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role revision: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var rev roleRevision
+	if err := entry.DecodeJSON(&rev); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+const pathRoleHistoryHelpSyn = `
+Read the history of a role.
+`
+
+const pathRoleHistoryHelpDesc = `
+Every write of a role, including its deletion, is kept as a revision of the
+role: the entity that made it, when, the settings it changed, and the role as
+written. Listing the history returns the revisions, oldest first, with a
+summary of each; reading one returns it in full.
+
+The history of a role keeps its last "history_retention" revisions, 10 by
+default. It is kept after the role is deleted.
+`
+
+const pathRoleRollbackHelpSyn = `
+Roll a role back to a previous revision.
+`
+
+const pathRoleRollbackHelpDesc = `
+This path writes the settings of the given revision of the role back, which
+is recorded as a new revision. The history retention of the role is kept.
+A deleted role can be brought back by rolling it back to a revision from
+before its deletion.
+`
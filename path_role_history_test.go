@@ -0,0 +1,111 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleHistory(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	writeRole := func(t *testing.T, data map[string]interface{}, entityID string) {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:   logical.UpdateOperation,
+			Path:        "roles/history-role",
+			Data:        data,
+			EntityID:    entityID,
+			DisplayName: "token-" + entityID,
+			Storage:     s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "unexpected error response: %v", resp)
+	}
+	request := func(t *testing.T, op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: op,
+			Path:      path,
+			Data:      data,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	writeRole(t, map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+	}, "alice")
+	writeRole(t, map[string]interface{}{
+		"roles": []string{"operator", "administrator"},
+		"ttl":   600,
+	}, "bob")
+
+	resp := request(t, logical.ListOperation, "roles/history-role/history", nil)
+	require.Equal(t, []string{"1", "2"}, resp.Data["keys"])
+	info := resp.Data["key_info"].(map[string]interface{})
+	require.Equal(t, "create", info["1"].(map[string]interface{})["operation"])
+	require.Equal(t, "alice", info["1"].(map[string]interface{})["entity_id"])
+	require.Equal(t, "update", info["2"].(map[string]interface{})["operation"])
+	require.Equal(t, "bob", info["2"].(map[string]interface{})["entity_id"])
+	require.Equal(t, "token-bob", info["2"].(map[string]interface{})["display_name"])
+	require.Equal(t, []string{"roles", "ttl"}, info["2"].(map[string]interface{})["changes"])
+
+	resp = request(t, logical.ReadOperation, "roles/history-role/history/1", nil)
+	require.Equal(t, 1, resp.Data["version"])
+	require.Equal(t, []string{"operator"}, resp.Data["role"].(map[string]interface{})["roles"])
+
+	// The roles list is left alone.
+	resp = request(t, logical.ListOperation, "roles/", nil)
+	require.Equal(t, []string{"history-role"}, resp.Data["keys"])
+
+	t.Run("rollback", func(t *testing.T) {
+		resp := request(t, logical.UpdateOperation, "roles/history-role/rollback", map[string]interface{}{"version": 1})
+		require.Nil(t, resp)
+
+		role, err := b.getRole(ctx, s, "history-role")
+		require.NoError(t, err)
+		require.Equal(t, []string{"operator"}, role.Roles)
+		require.Zero(t, role.TTL)
+
+		resp = request(t, logical.ReadOperation, "roles/history-role/history/3", nil)
+		require.Equal(t, "rollback", resp.Data["operation"])
+		require.Equal(t, 1, resp.Data["rolled_back_to"])
+		require.Equal(t, []string{"roles", "ttl"}, resp.Data["changes"])
+
+		resp = request(t, logical.UpdateOperation, "roles/history-role/rollback", map[string]interface{}{"version": 42})
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		writeRole(t, map[string]interface{}{"history_retention": 3}, "alice")
+		writeRole(t, map[string]interface{}{"contact": "other@example.com"}, "alice")
+		writeRole(t, map[string]interface{}{"contact": "team@example.com"}, "alice")
+
+		resp := request(t, logical.ListOperation, "roles/history-role/history", nil)
+		require.Equal(t, []string{"4", "5", "6"}, resp.Data["keys"])
+	})
+
+	t.Run("deleted roles keep their history", func(t *testing.T) {
+		request(t, logical.DeleteOperation, "roles/history-role", nil)
+
+		resp := request(t, logical.ReadOperation, "roles/history-role/history/7", nil)
+		require.Equal(t, "delete", resp.Data["operation"])
+		require.NotContains(t, resp.Data, "role")
+
+		resp = request(t, logical.UpdateOperation, "roles/history-role/rollback", map[string]interface{}{"version": 7})
+		require.True(t, resp.IsError())
+
+		request(t, logical.UpdateOperation, "roles/history-role/rollback", map[string]interface{}{"version": 6})
+		role, err := b.getRole(ctx, s, "history-role")
+		require.NoError(t, err)
+		require.NotNil(t, role)
+		require.Equal(t, "team@example.com", role.Contact)
+	})
+}
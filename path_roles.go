@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -14,9 +15,25 @@ type horizonRoleEntry struct {
 	Instance         string                 `json:"instance"`
 	Roles            []string               `json:"roles"`
 	Contact          string                 `json:"contact"`
+	ContactTemplate  string                 `json:"contact_template"`
 	TTL              time.Duration          `json:"ttl"`
 	MaxTTL           time.Duration          `json:"max_ttl"`
 	CredentialConfig map[string]interface{} `json:"credential_config"`
+	RevocationMode   string                 `json:"revocation_mode"`
+	PurgeAfter       time.Duration          `json:"purge_after"`
+	// MaxActiveCredentials caps the number of credentials of the role that
+	// can be active at once. Zero means no cap.
+	MaxActiveCredentials int `json:"max_active_credentials"`
+	// GroupRoles and MetadataRoles map the identity groups and the value of
+	// the MetadataKey metadata of the requesting entity onto Horizon roles,
+	// assigned on top of Roles.
+	GroupRoles    map[string][]string `json:"group_roles"`
+	MetadataKey   string              `json:"metadata_key"`
+	MetadataRoles map[string][]string `json:"metadata_roles"`
+	AccountMode   string              `json:"account_mode"`
+	// HistoryRetention is the number of revisions of the role kept in its
+	// history. Zero means defaultRoleHistoryRetention.
+	HistoryRetention int `json:"history_retention"`
 }
 
 func pathListRoles(b *horizonBackend) []*framework.Path {
@@ -71,10 +88,49 @@ func fieldsForType(roleType string) map[string]*framework.FieldSchema {
 			Type:        framework.TypeString,
 			Description: "Contact needed for the role assignement",
 		},
+		"contact_template": {
+			Type:        framework.TypeString,
+			Description: `Identity template of the contact, such as "{{identity.entity.metadata.email}}". Falls back to contact when it does not resolve.`,
+		},
 		"credential_config": {
 			Type:        framework.TypeMap,
 			Description: "Password and Username policies",
 		},
+		"revocation_mode": {
+			Type:        framework.TypeString,
+			Description: `What happens to the account when its lease ends: "delete" (default), "disable", "remove_roles" or "scramble_password".`,
+			Default:     revocationModeDelete,
+		},
+		"purge_after": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Time after which an account kept by its revocation mode is deleted. Defaults to 0 (kept forever). Not allowed with the delete mode.",
+		},
+		"max_active_credentials": {
+			Type:        framework.TypeInt,
+			Description: "Maximum number of credentials of the role that can be active at once. Defaults to 0 (no maximum).",
+		},
+		"group_roles": {
+			Type:        framework.TypeKVPairs,
+			Description: "Horizon roles, comma-separated, assigned to the members of a Vault identity group, keyed by group name.",
+		},
+		"account_mode": {
+			Type:        framework.TypeString,
+			Description: `"per_lease" (default) to create an account per credential, or "per_entity" to reuse one account per Vault entity.`,
+			Default:     accountModePerLease,
+		},
+		"history_retention": {
+			Type:        framework.TypeInt,
+			Description: "Number of revisions of the role kept in its history. Defaults to 10.",
+			Default:     defaultRoleHistoryRetention,
+		},
+		"metadata_key": {
+			Type:        framework.TypeString,
+			Description: "Metadata key of the requesting entity whose value selects roles from metadata_roles.",
+		},
+		"metadata_roles": {
+			Type:        framework.TypeKVPairs,
+			Description: "Horizon roles, comma-separated, assigned to the entities whose metadata_key has a given value, keyed by value.",
+		},
 	}
 
 	for k, v := range dynamicFields() {
@@ -107,11 +163,29 @@ func (b *horizonBackend) pathRoleExistenceCheck(ctx context.Context, req *logica
 }
 
 func (b *horizonBackend) pathRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, horizonRolePath+d.Get("name").(string))
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Delete(ctx, horizonRolePath+name)
 	if err != nil {
 		return nil, fmt.Errorf("error deleting horizon role: %w", err)
 	}
 
+	if previous != nil {
+		err = b.recordRoleRevision(ctx, req, name, previous, &roleRevision{Operation: roleOperationDelete})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return nil, nil
 }
 
@@ -124,17 +198,44 @@ func (b *horizonBackend) pathRoleRead(ctx context.Context, req *logical.Request,
 		return nil, errors.New("no role")
 	}
 
-	data := map[string]interface{}{
-		"instance":    role.Instance,
-		"default_ttl": role.TTL.Seconds(),
-		"max_ttl":     role.MaxTTL.Seconds(),
+	active, err := getActiveCredentials(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
 	}
 
+	data := roleResponseData(role)
+	data["active_credentials"] = active
+
 	return &logical.Response{
 		Data: data,
 	}, nil
 }
 
+// roleResponseData returns the settings of a role as they are read.
+func roleResponseData(role *horizonRoleEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"instance":         role.Instance,
+		"roles":            role.Roles,
+		"contact":          role.Contact,
+		"contact_template": role.ContactTemplate,
+		"default_ttl":      role.TTL.Seconds(),
+		"max_ttl":          role.MaxTTL.Seconds(),
+
+		"revocation_mode": role.RevocationMode,
+		"purge_after":     role.PurgeAfter.Seconds(),
+
+		"max_active_credentials": role.MaxActiveCredentials,
+
+		"group_roles":    formatRoleMapping(role.GroupRoles),
+		"metadata_key":   role.MetadataKey,
+		"metadata_roles": formatRoleMapping(role.MetadataRoles),
+
+		"account_mode": role.AccountMode,
+
+		"history_retention": role.historyRetention(),
+	}
+}
+
 func (b *horizonBackend) pathRoleList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	path := horizonRolePath
 	entries, err := req.Storage.List(ctx, path)
@@ -152,13 +253,20 @@ func (b *horizonBackend) pathRoleWrite(ctx context.Context, req *logical.Request
 		return logical.ErrorResponse("missing role name"), nil
 	}
 
-	roleEntry, err := b.getRole(ctx, req.Storage, name.(string))
+	lock := locksutil.LockForKey(b.roleLocks, name.(string))
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := b.getRole(ctx, req.Storage, name.(string))
 	if err != nil {
 		return nil, err
 	}
 
-	if roleEntry == nil {
-		roleEntry = &horizonRoleEntry{}
+	roleEntry := &horizonRoleEntry{}
+	operation := roleOperationCreate
+	if previous != nil {
+		*roleEntry = *previous
+		operation = roleOperationUpdate
 	}
 
 	createOperation := (req.Operation == logical.CreateOperation)
@@ -189,6 +297,10 @@ func (b *horizonBackend) pathRoleWrite(ctx context.Context, req *logical.Request
 		roleEntry.Contact = contactRaw.(string)
 	}
 
+	if contactTemplateRaw, ok := d.GetOk("contact_template"); ok {
+		roleEntry.ContactTemplate = contactTemplateRaw.(string)
+	}
+
 	if ttlRaw, ok := d.GetOk("ttl"); ok {
 		roleEntry.TTL = time.Duration(ttlRaw.(int)) * time.Second
 	} else if createOperation {
@@ -201,17 +313,92 @@ func (b *horizonBackend) pathRoleWrite(ctx context.Context, req *logical.Request
 		roleEntry.MaxTTL = time.Duration(d.Get("max_ttl").(int)) * time.Second
 	}
 
-	if roleEntry.MaxTTL != 0 && roleEntry.TTL > roleEntry.MaxTTL {
-		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	if modeRaw, ok := d.GetOk("revocation_mode"); ok {
+		roleEntry.RevocationMode = modeRaw.(string)
+	} else if createOperation {
+		roleEntry.RevocationMode = d.Get("revocation_mode").(string)
+	}
+
+	if purgeAfterRaw, ok := d.GetOk("purge_after"); ok {
+		roleEntry.PurgeAfter = time.Duration(purgeAfterRaw.(int)) * time.Second
+	}
+
+	if maxActiveRaw, ok := d.GetOk("max_active_credentials"); ok {
+		roleEntry.MaxActiveCredentials = maxActiveRaw.(int)
+	}
+
+	if groupRolesRaw, ok := d.GetOk("group_roles"); ok {
+		roleEntry.GroupRoles = parseRoleMapping(groupRolesRaw.(map[string]string))
+	}
+	if metadataKeyRaw, ok := d.GetOk("metadata_key"); ok {
+		roleEntry.MetadataKey = metadataKeyRaw.(string)
+	}
+	if metadataRolesRaw, ok := d.GetOk("metadata_roles"); ok {
+		roleEntry.MetadataRoles = parseRoleMapping(metadataRolesRaw.(map[string]string))
+	}
+	if accountModeRaw, ok := d.GetOk("account_mode"); ok {
+		roleEntry.AccountMode = accountModeRaw.(string)
+	} else if createOperation {
+		roleEntry.AccountMode = d.Get("account_mode").(string)
+	}
+	if retentionRaw, ok := d.GetOk("history_retention"); ok {
+		roleEntry.HistoryRetention = retentionRaw.(int)
+	} else if createOperation {
+		roleEntry.HistoryRetention = d.Get("history_retention").(int)
+	}
+
+	if err := roleEntry.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	if err := setRole(ctx, req.Storage, name.(string), roleEntry); err != nil {
 		return nil, err
 	}
+	err = b.recordRoleRevision(ctx, req, name.(string), previous, &roleRevision{
+		Operation: operation,
+		Role:      roleEntry,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	return nil, nil
 }
 
+// validate checks that the settings of the role are consistent.
+func (r *horizonRoleEntry) validate() error {
+	if r.ContactTemplate != "" {
+		if err := validateContactTemplate(r.ContactTemplate); err != nil {
+			return fmt.Errorf("invalid contact_template: %w", err)
+		}
+	}
+	if r.MaxTTL != 0 && r.TTL > r.MaxTTL {
+		return errors.New("ttl cannot be greater than max_ttl")
+	}
+	if r.RevocationMode != "" && !validRevocationMode(r.RevocationMode) {
+		return fmt.Errorf("invalid revocation_mode %q", r.RevocationMode)
+	}
+	if r.PurgeAfter < 0 {
+		return errors.New("purge_after cannot be negative")
+	}
+	if r.PurgeAfter > 0 && (r.RevocationMode == "" || r.RevocationMode == revocationModeDelete) {
+		return errors.New("purge_after requires a revocation_mode that keeps the account")
+	}
+	if r.MaxActiveCredentials < 0 {
+		return errors.New("max_active_credentials cannot be negative")
+	}
+	if r.AccountMode != "" && !validAccountMode(r.AccountMode) {
+		return fmt.Errorf("invalid account_mode %q", r.AccountMode)
+	}
+	if len(r.MetadataRoles) > 0 && r.MetadataKey == "" {
+		return errors.New("metadata_roles requires metadata_key")
+	}
+	if r.HistoryRetention < 0 {
+		return errors.New("history_retention cannot be negative")
+	}
+	return nil
+}
+
 // setRole adds the role to the Vault storage API
 func setRole(ctx context.Context, s logical.Storage, name string, roleEntry *horizonRoleEntry) error {
 	entry, err := logical.StorageEntryJSON(horizonRolePath+name, roleEntry)
@@ -230,13 +417,15 @@ func setRole(ctx context.Context, s logical.Storage, name string, roleEntry *hor
 	return nil
 }
 
-// getRole gets the role from the Vault storage API
+// getRole gets the role from the Vault storage API. It reads where setRole
+// writes, so that an update starts from the stored role and only changes the
+// fields it is given.
 func (b *horizonBackend) getRole(ctx context.Context, s logical.Storage, name string) (*horizonRoleEntry, error) {
 	if name == "" {
 		return nil, fmt.Errorf("missing role name")
 	}
 
-	entry, err := s.Get(ctx, "role/"+name)
+	entry, err := s.Get(ctx, horizonRolePath+name)
 	if err != nil {
 		return nil, err
 	}
@@ -300,5 +489,9 @@ The "instance" parameter references the backend to use with the role.
 The "roles" parameter should be the roles that are already defined in horizon, and those you want 
 to assign the accounts you will create.
 
+The "group_roles" and "metadata_roles" parameters map the Vault identity
+groups and metadata of the requesting entity onto additional horizon roles,
+so that a single role can serve several teams.
+
 For more details, take a look on the documentation.
 `
@@ -80,6 +80,27 @@ func TestUserRole(t *testing.T) {
 		require.Equal(t, instance, resp.Data["instance"])
 	})
 
+	t.Run("Update keeps the other fields", func(t *testing.T) {
+		_, err := testCredsRoleUpdate(t, b, s, map[string]interface{}{
+			"roles":   []string{"role1", "role2"},
+			"contact": "admin@example.com",
+		})
+		require.NoError(t, err)
+
+		_, err = testCredsRoleUpdate(t, b, s, map[string]interface{}{
+			"ttl": "2m",
+		})
+		require.NoError(t, err)
+
+		resp, err := testCredsRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, instance, resp.Data["instance"])
+		require.Equal(t, []string{"role1", "role2"}, resp.Data["roles"])
+		require.Equal(t, "admin@example.com", resp.Data["contact"])
+		require.Equal(t, float64(120), resp.Data["default_ttl"])
+		require.Equal(t, float64(5*3600), resp.Data["max_ttl"])
+	})
+
 	t.Run("Delete User Role", func(t *testing.T) {
 		_, err := testCredsRoleDelete(t, b, s)
 
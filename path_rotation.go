@@ -3,9 +3,9 @@ package horizonsecretsengine
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"time"
 
-	horizon "github.com/evertrust/horizon-go"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -32,21 +32,59 @@ func pathRotateRootCredentials(b *horizonBackend) []*framework.Path {
 			HelpSynopsis:    pathRotateCredentialsUpdateHelpSyn,
 			HelpDescription: pathRotateCredentialsUpdateHelpDesc,
 		},
+		{
+			Pattern: "creds/" + framework.GenericNameRegex("name") + "/rotate$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the role.",
+				},
+				"username": {
+					Type:        framework.TypeString,
+					Description: "Identifier of the horizon account of the credential.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathRotateCredsUpdate,
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+
+			HelpSynopsis:    pathRotateCredsHelpSyn,
+			HelpDescription: pathRotateCredsHelpDesc,
+		},
 	}
 }
 
 func (b *horizonBackend) pathRotateRootCredentialsUpdate() framework.OperationFunc {
-	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (_ *logical.Response, retErr error) {
 		name := data.Get("name").(string)
 		if name == "" {
 			return logical.ErrorResponse(respErrEmptyName), nil
 		}
 
+		logger := b.requestLogger(req, "rotate-root", "instance", name)
+
+		lock := b.instanceLock(name)
+		lock.Lock()
+		defer lock.Unlock()
+
 		config, err := b.getConfig(ctx, req.Storage, name)
 		if err != nil {
+			emitOutcome(false, instanceLabels(name), "rotate_root")
 			return nil, err
 		}
 
+		// The passwords never end up in the recorded error.
+		var hidden []string
+		defer func() {
+			emitOutcome(retErr == nil, instanceLabels(name), "rotate_root")
+			b.recordRootRotation(req.Storage, name, retErr, hidden...)
+		}()
+
 		rootUsername, ok := config.ConnectionDetails["username"].(string)
 		if !ok || rootUsername == "" {
 			return nil, fmt.Errorf("unable to rotate root credentials: no username in configuration")
@@ -65,29 +103,193 @@ func (b *horizonBackend) pathRotateRootCredentialsUpdate() framework.OperationFu
 			return nil, fmt.Errorf("failed to generate password: %s", err)
 		}
 		config.ConnectionDetails["password"] = newPassword
+		hidden = []string{oldPassword, newPassword}
 
-		endpoint, err := url.Parse(config.HorizonEndpoint)
+		client, err := b.newClient(name, config)
 		if err != nil {
 			return nil, err
 		}
+		client.withCredentials(rootUsername, oldPassword)
+		client.logger = logger.With("account", rootUsername)
+
+		// Record the rotation, so that the old password is put back if the
+		// new one is set in horizon but never stored.
+		wal := &walRootPassword{
+			Instance:    name,
+			Username:    rootUsername,
+			OldPassword: oldPassword,
+			NewPassword: newPassword,
+		}
+		walID, err := framework.PutWAL(ctx, req.Storage, walTypeRootPassword, wal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record root rotation: %w", err)
+		}
 
-		h := new(horizon.Horizon)
-		h.Init(*endpoint, config.ConnectionDetails["username"].(string), oldPassword, "", "")
-		root, err := h.Local.GetAccount(rootUsername)
+		root, err := client.getAccount(ctx, rootUsername)
 		if err != nil {
+			logger.Error("failed to read root account", "account", rootUsername, "error", redact(err.Error(), oldPassword))
+			_ = framework.DeleteWAL(ctx, req.Storage, walID)
 			return nil, err
 		}
-		h.Local.SetPassword(root, newPassword)
+		// A retry would authenticate with the old password, which a lost
+		// attempt may already have replaced: a failure is left to the
+		// rollback, which checks which password Horizon took.
+		client.retry.MaxRetries = 0
+		err = client.setPassword(ctx, root, newPassword)
+		if err != nil {
+			logger.Error("failed to set new root password, putting the old one back", "account", rootUsername, "error", redact(err.Error(), oldPassword, newPassword))
+			b.rollbackWorkflow(req.Storage, walID, walTypeRootPassword, wal)
+			return nil, fmt.Errorf("failed to set new root password: %w", err)
+		}
+
+		// Horizon may keep accepting the old password for a little while,
+		// and reject the new one meanwhile.
+		// The periodic function clears it once the window is over.
+		if config.RootPasswordGracePeriod > 0 {
+			config.PreviousPassword = oldPassword
+			config.PreviousPasswordExpiresAt = time.Now().Add(config.RootPasswordGracePeriod)
+		} else {
+			config.clearPreviousPassword()
+		}
 
 		err = storeConfig(ctx, req.Storage, name, config)
 		if err != nil {
+			logger.Error("failed to store new root password, putting the old one back", "account", rootUsername, "error", err)
+			b.rollbackWorkflow(req.Storage, walID, walTypeRootPassword, wal)
 			return nil, err
 		}
 
+		// A leftover entry is harmless: the rollback sees the new password
+		// in storage and does nothing.
+		_ = framework.DeleteWAL(ctx, req.Storage, walID)
+
+		logger.Info("root credentials rotated", "account", rootUsername, "grace_period", config.RootPasswordGracePeriod)
 		return nil, nil
 	}
 }
 
+// clearExpiredPreviousPasswords drops the previous root password of the
+// instances whose grace window is over.
+func (b *horizonBackend) clearExpiredPreviousPasswords(ctx context.Context, s logical.Storage) error {
+	instances, err := s.List(ctx, horizonConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	for _, instance := range instances {
+		if err := b.clearExpiredPreviousPassword(ctx, s, instance); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("instance %q: %w", instance, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (b *horizonBackend) clearExpiredPreviousPassword(ctx context.Context, s logical.Storage, instance string) error {
+	expired := func(config *horizonConfig) bool {
+		return config.PreviousPassword != "" && config.previousPassword(time.Now()) == ""
+	}
+
+	// Most instances have nothing to clear, which is checked without
+	// holding up their requests.
+	config, err := b.getConfig(ctx, s, instance)
+	if err != nil || !expired(config) {
+		return err
+	}
+
+	lock := b.instanceLock(instance)
+	lock.Lock()
+	defer lock.Unlock()
+
+	config, err = b.getConfig(ctx, s, instance)
+	if err != nil || !expired(config) {
+		return err
+	}
+	config.clearPreviousPassword()
+	if err := storeConfig(ctx, s, instance, config); err != nil {
+		return err
+	}
+	b.Logger().Debug("previous root password cleared", "instance", instance)
+	return nil
+}
+
+// pathRotateCredsUpdate sets a new password on the account of an active
+// credential. The lease and the account identifier are left untouched.
+func (b *horizonBackend) pathRotateCredsUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	username := data.Get("username").(string)
+	if username == "" {
+		return logical.ErrorResponse("username is required"), nil
+	}
+
+	role, err := b.Role(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", name)), nil
+	}
+
+	managed, err := getManagedAccount(ctx, req.Storage, role.Instance, username)
+	if err != nil {
+		return nil, err
+	}
+	if managed == nil || managed.Role != name || managed.revoked() {
+		return logical.ErrorResponse("no active credential of role %q for account %q", name, username), nil
+	}
+	// Only the entity that requested the credential may rotate it, or the
+	// token itself when it had no entity.
+	if managed.EntityID != "" && managed.EntityID != req.EntityID {
+		return nil, logical.ErrPermissionDenied
+	}
+	if managed.EntityID == "" && (managed.ClientTokenAccessor == "" || managed.ClientTokenAccessor != req.ClientTokenAccessor) {
+		return nil, logical.ErrPermissionDenied
+	}
+
+	lock := b.instanceLock(role.Instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	config, err := b.getConfig(ctx, req.Storage, role.Instance)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.newClient(role.Instance, config)
+	if err != nil {
+		return nil, err
+	}
+
+	pg, err := newPasswordGenerator(role.CredentialConfig)
+	if err != nil {
+		return nil, err
+	}
+	pwd, err := pg.generate(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate password: %w", err)
+	}
+
+	acc, err := client.getAccount(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.setPassword(ctx, acc, pwd); err != nil {
+		return nil, err
+	}
+
+	managed.PasswordRotatedAt = time.Now()
+	managed.PasswordRotations++
+	if err := putManagedAccount(ctx, req.Storage, managed); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username": username,
+			"password": pwd,
+		},
+	}, nil
+}
+
 const pathRotateCredentialsUpdateHelpSyn = `
 Request to rotate the root credentials for a certain database connection.
 `
@@ -95,3 +297,18 @@ Request to rotate the root credentials for a certain database connection.
 const pathRotateCredentialsUpdateHelpDesc = `
 This path attempts to rotate the root credentials for the given database. 
 `
+
+const pathRotateCredsHelpSyn = `
+Rotate the password of an active credential.
+`
+
+const pathRotateCredsHelpDesc = `
+This path sets a new password on the horizon account of an active credential
+of the role, such as after the password leaked, and returns it. The lease and
+the account identifier are kept. The rotation is recorded in the inventory of
+managed accounts.
+
+Only the entity that requested the credential can rotate it. A credential
+requested by a token without an entity can only be rotated with that same
+token.
+`
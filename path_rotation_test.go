@@ -0,0 +1,213 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateRootConcurrency(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	// The mock rejects requests signed with a stale root password.
+	m.addAccount(username)
+	m.setPassword(username, password)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+		"ttl":      testTTL,
+		"max_ttl":  testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	const workers, iterations = 4, 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations*2+iterations)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				resp, err := b.HandleRequest(ctx, &logical.Request{
+					Operation: logical.ReadOperation,
+					Path:      "creds/mock-role",
+					Storage:   s,
+				})
+				if err == nil && resp.IsError() {
+					err = resp.Error()
+				}
+				if err != nil {
+					errs <- err
+					continue
+				}
+				_, err = b.HandleRequest(ctx, &logical.Request{
+					Operation: logical.RevokeOperation,
+					Storage:   s,
+					Secret:    resp.Secret,
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < iterations; j++ {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "rotate-root/mock",
+				Storage:   s,
+			})
+			if err == nil && resp != nil && resp.IsError() {
+				err = resp.Error()
+			}
+			if err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.NotEqual(t, password, m.account(username).Password)
+
+	queue, err := s.List(ctx, revocationQueuePath)
+	require.NoError(t, err)
+	require.Empty(t, queue)
+
+	// Only the root account is left.
+	require.Equal(t, []string{username}, m.accountIdentifiers())
+}
+
+func TestRotateRootFailure(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+	m.addAccount(username)
+	m.setPassword(username, password)
+
+	// The rollback runs under the instance lock held by the rotation.
+	m.failRoute(http.MethodPatch, localsPath, http.StatusBadRequest)
+	_, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-root/mock",
+		Storage:   s,
+	})
+	require.Error(t, err)
+	m.failRoute(http.MethodPatch, localsPath, 0)
+
+	require.Equal(t, password, m.account(username).Password)
+	config, err := b.getConfig(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Equal(t, password, config.ConnectionDetails["password"])
+
+	// The new password is set but the answer is lost: it is not retried
+	// with the old one, and the rollback puts the old one back.
+	m.dropNext(http.MethodPatch, localsPath)
+	calls := m.callCount()
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-root/mock",
+		Storage:   s,
+	})
+	require.Error(t, err)
+	require.Equal(t, calls+4, m.callCount())
+	require.Equal(t, password, m.account(username).Password)
+}
+
+func TestRotateRootGracePeriod(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{
+		"root_password_grace_period": 60,
+	})
+	m.addAccount(username)
+	m.setPassword(username, password)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+		"ttl":      testTTL,
+		"max_ttl":  testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-root/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, password, m.account(username).Password)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, float64(60), resp.Data["root_password_grace_period"])
+	require.NotEmpty(t, resp.Data["previous_password_expires_at"])
+	require.NotContains(t, resp.Data, "previous_password")
+
+	readCreds := func() error {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/mock-role",
+			Storage:   s,
+		})
+		if err == nil && resp.IsError() {
+			err = resp.Error()
+		}
+		return err
+	}
+
+	// Horizon still only knows the old password.
+	m.setPassword(username, password)
+	require.NoError(t, readCreds())
+
+	t.Run("cleanup waits for the end of the window", func(t *testing.T) {
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, ids)
+
+		require.NoError(t, b.clearExpiredPreviousPasswords(ctx, s))
+		config, err := b.getConfig(ctx, s, "mock")
+		require.NoError(t, err)
+		require.Equal(t, password, config.PreviousPassword)
+	})
+
+	t.Run("cleanup clears the previous password", func(t *testing.T) {
+		config, err := b.getConfig(ctx, s, "mock")
+		require.NoError(t, err)
+		config.PreviousPasswordExpiresAt = time.Now().Add(-time.Second)
+		require.NoError(t, storeConfig(ctx, s, "mock", config))
+
+		require.NoError(t, b.clearExpiredPreviousPasswords(ctx, s))
+
+		config, err = b.getConfig(ctx, s, "mock")
+		require.NoError(t, err)
+		require.Empty(t, config.PreviousPassword)
+		require.Error(t, readCreds())
+	})
+}
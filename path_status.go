@@ -0,0 +1,360 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	statusProbePath  = "status/"
+	rootRotationPath = "root-rotation/"
+
+	// statusProbeInterval is how often the periodic probe checks an
+	// instance. Reads of the status are served from its last result.
+	statusProbeInterval = time.Minute
+	statusProbeTimeout  = 10 * time.Second
+)
+
+// instanceProbe is the outcome of the last health check of an instance.
+type instanceProbe struct {
+	Instance      string        `json:"instance"`
+	CheckedAt     time.Time     `json:"checked_at"`
+	Reachable     bool          `json:"reachable"`
+	Authenticated bool          `json:"authenticated"`
+	Latency       time.Duration `json:"latency"`
+	Version       string        `json:"horizon_version"`
+	Error         string        `json:"error"`
+}
+
+// rootRotation is the outcome of the last rotation of the root credentials
+// of an instance.
+type rootRotation struct {
+	RotatedAt time.Time `json:"rotated_at"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error"`
+}
+
+func pathStatus(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "status/?$",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathStatusReadAll,
+			},
+
+			HelpSynopsis:    pathStatusHelpSyn,
+			HelpDescription: pathStatusHelpDesc,
+		},
+		{
+			Pattern: "status/" + framework.GenericNameRegex("instance"),
+			Fields: map[string]*framework.FieldSchema{
+				"instance": {
+					Type:        framework.TypeString,
+					Description: "Instance of horizon.",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathStatusRead,
+			},
+
+			HelpSynopsis:    pathStatusHelpSyn,
+			HelpDescription: pathStatusHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathStatusRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	instance := data.Get("instance").(string)
+	if instance == "" {
+		return logical.ErrorResponse(respErrEmptyInstance), nil
+	}
+
+	entry, err := req.Storage.Get(ctx, horizonConfigPath+instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read horizon configuration: %w", err)
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("unknown instance: %s", instance)), nil
+	}
+
+	status, err := b.instanceStatus(ctx, req.Storage, instance)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: status,
+	}, nil
+}
+
+func (b *horizonBackend) pathStatusReadAll(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	instances, err := req.Storage.List(ctx, horizonConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(instances)
+
+	statuses := make(map[string]interface{}, len(instances))
+	healthy := true
+	for _, instance := range instances {
+		status, err := b.instanceStatus(ctx, req.Storage, instance)
+		if err != nil {
+			return nil, err
+		}
+		statuses[instance] = status
+		if status["reachable"] != true || status["authenticated"] != true {
+			healthy = false
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"healthy":   healthy,
+			"instances": statuses,
+		},
+	}, nil
+}
+
+// instanceStatus gathers the status of an instance from storage. Horizon is
+// never called: until the periodic probe has checked the instance, the
+// fields of the probe are null.
+func (b *horizonBackend) instanceStatus(ctx context.Context, s logical.Storage, instance string) (map[string]interface{}, error) {
+	probe, err := getInstanceProbe(ctx, s, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	status := map[string]interface{}{
+		"instance":        instance,
+		"checked_at":      nil,
+		"reachable":       nil,
+		"authenticated":   nil,
+		"latency_ms":      nil,
+		"horizon_version": nil,
+		"error":           nil,
+		"circuit_breaker": b.breakerState(instance).String(),
+	}
+	if probe != nil {
+		status["checked_at"] = probe.CheckedAt.Format(time.RFC3339)
+		status["reachable"] = probe.Reachable
+		status["authenticated"] = probe.Authenticated
+		status["latency_ms"] = probe.Latency.Milliseconds()
+		status["horizon_version"] = probe.Version
+		status["error"] = probe.Error
+	}
+
+	rotation, err := getRootRotation(ctx, s, instance)
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil {
+		status["last_root_rotation"] = map[string]interface{}{
+			"rotated_at": rotation.RotatedAt.Format(time.RFC3339),
+			"success":    rotation.Success,
+			"error":      rotation.Error,
+		}
+	}
+
+	queue, err := listRevocationQueue(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	depth, failed := 0, 0
+	for _, entry := range queue {
+		switch {
+		case entry.Instance != instance:
+		case entry.failed():
+			failed++
+		default:
+			depth++
+		}
+	}
+	status["revocation_queue_depth"] = depth
+	status["revocation_queue_failed"] = failed
+
+	managed, err := listManagedAccounts(ctx, s, instance)
+	if err != nil {
+		return nil, err
+	}
+	active := 0
+	for _, acc := range managed {
+		if !acc.revoked() {
+			active++
+		}
+	}
+	status["active_credentials"] = active
+
+	return status, nil
+}
+
+// probeInstances probes the instances whose last probe is older than
+// statusProbeInterval.
+func (b *horizonBackend) probeInstances(ctx context.Context, s logical.Storage) error {
+	instances, err := s.List(ctx, horizonConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	for _, instance := range instances {
+		last, err := getInstanceProbe(ctx, s, instance)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if last != nil && time.Since(last.CheckedAt) < statusProbeInterval {
+			continue
+		}
+
+		probe, err := b.probeInstanceLocked(ctx, s, instance)
+		if err == nil {
+			err = putInstanceProbe(ctx, s, probe)
+		}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("instance %q: %w", instance, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (b *horizonBackend) probeInstanceLocked(ctx context.Context, s logical.Storage, instance string) (*instanceProbe, error) {
+	lock := b.instanceLock(instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	config, err := b.getConfig(ctx, s, instance)
+	if err != nil {
+		return nil, err
+	}
+	return b.probeInstance(ctx, instance, config)
+}
+
+// probeInstance checks that an instance answers, and that the engine can
+// authenticate to it. Failing to reach Horizon is reported in the probe, not
+// as an error.
+func (b *horizonBackend) probeInstance(ctx context.Context, instance string, config *horizonConfig) (*instanceProbe, error) {
+	client, err := b.newClient(instance, config)
+	if err != nil {
+		return nil, err
+	}
+	// A single attempt: the probe runs again soon enough.
+	client.retry.MaxRetries = 0
+
+	ctx, cancel := context.WithTimeout(ctx, statusProbeTimeout)
+	defer cancel()
+
+	probe := &instanceProbe{
+		Instance:  instance,
+		CheckedAt: time.Now(),
+	}
+
+	start := time.Now()
+	info, err := client.getLicense(ctx)
+	probe.Latency = time.Since(start)
+	switch {
+	case err == nil:
+		probe.Reachable = true
+		probe.Version = info.Version
+	case isHorizonAnswer(err):
+		probe.Reachable = true
+	default:
+		probe.Error = err.Error()
+		return probe, nil
+	}
+
+	_, err = client.getAccount(ctx, config.rootUsername())
+	switch {
+	case err == nil || isNotFound(err):
+		probe.Authenticated = true
+	default:
+		probe.Error = err.Error()
+	}
+
+	b.Logger().Debug("probed instance", "operation", "status", "instance", instance,
+		"reachable", probe.Reachable, "authenticated", probe.Authenticated, "latency", probe.Latency)
+	return probe, nil
+}
+
+// recordRootRotation stores the outcome of a rotation of the root
+// credentials of an instance.
+func (b *horizonBackend) recordRootRotation(s logical.Storage, instance string, err error, secrets ...string) {
+	rotation := &rootRotation{
+		RotatedAt: time.Now(),
+		Success:   err == nil,
+	}
+	if err != nil {
+		rotation.Error = redact(err.Error(), secrets...)
+	}
+
+	// The request context may be done already.
+	entry, putErr := logical.StorageEntryJSON(rootRotationPath+instance, rotation)
+	if putErr == nil {
+		putErr = s.Put(context.Background(), entry)
+	}
+	if putErr != nil {
+		b.Logger().Warn("failed to record root rotation", "instance", instance, "error", putErr)
+	}
+}
+
+func getRootRotation(ctx context.Context, s logical.Storage, instance string) (*rootRotation, error) {
+	entry, err := s.Get(ctx, rootRotationPath+instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root rotation: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var rotation rootRotation
+	if err := entry.DecodeJSON(&rotation); err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+func getInstanceProbe(ctx context.Context, s logical.Storage, instance string) (*instanceProbe, error) {
+	entry, err := s.Get(ctx, statusProbePath+instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance status: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var probe instanceProbe
+	if err := entry.DecodeJSON(&probe); err != nil {
+		return nil, err
+	}
+	return &probe, nil
+}
+
+func putInstanceProbe(ctx context.Context, s logical.Storage, probe *instanceProbe) error {
+	entry, err := logical.StorageEntryJSON(statusProbePath+probe.Instance, probe)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save instance status: %w", err)
+	}
+	return nil
+}
+
+const pathStatusHelpSyn = `
+Report the health of horizon instances.
+`
+
+const pathStatusHelpDesc = `
+This path reports whether an instance is reachable and accepts the root
+credentials, its latency and horizon version, as found by the last periodic
+probe; these are null until the instance has been probed once. It also
+reports the last root rotation, the revocation queue depth, the number of
+active credentials and the state of the circuit breaker of the instance.
+Reading "status/" reports every instance.
+`
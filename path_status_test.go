@@ -0,0 +1,126 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+	m.addAccount(username)
+	m.setPassword(username, password)
+
+	_, err := testCredsRoleCreate(t, b, s, "mock-role", map[string]interface{}{
+		"instance": "mock",
+		"roles":    []string{"operator"},
+		"contact":  "team@example.com",
+	})
+	require.NoError(t, err)
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/mock-role",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-root/mock",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+
+	readStatus := func(t *testing.T, path string) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// Reads never call horizon: the instance is unknown until probed.
+	calls := m.callCount()
+	resp := readStatus(t, "status/mock")
+	require.Equal(t, calls, m.callCount())
+	require.Nil(t, resp.Data["checked_at"])
+	require.Nil(t, resp.Data["reachable"])
+	require.Equal(t, false, readStatus(t, "status/").Data["healthy"])
+
+	require.NoError(t, b.probeInstances(ctx, s))
+	resp = readStatus(t, "status/mock")
+	require.NotNil(t, resp.Data["checked_at"])
+	require.Equal(t, true, resp.Data["reachable"])
+	require.Equal(t, true, resp.Data["authenticated"])
+	require.Equal(t, mockHorizonVersion, resp.Data["horizon_version"])
+	require.Equal(t, "closed", resp.Data["circuit_breaker"])
+	require.Equal(t, 1, resp.Data["active_credentials"])
+	require.Equal(t, 0, resp.Data["revocation_queue_depth"])
+	require.Equal(t, true, resp.Data["last_root_rotation"].(map[string]interface{})["success"])
+
+	t.Run("served from the last probe", func(t *testing.T) {
+		calls := m.callCount()
+		readStatus(t, "status/mock")
+		readStatus(t, "status/")
+		require.Equal(t, calls, m.callCount())
+	})
+
+	t.Run("probe reports authentication failures", func(t *testing.T) {
+		rotated := m.account(username).Password
+		m.setPassword(username, "changed-by-hand")
+		defer m.setPassword(username, rotated)
+		require.NoError(t, s.Delete(ctx, statusProbePath+"mock"))
+		require.NoError(t, b.probeInstances(ctx, s))
+
+		resp := readStatus(t, "status/")
+		require.Equal(t, false, resp.Data["healthy"])
+		status := resp.Data["instances"].(map[string]interface{})["mock"].(map[string]interface{})
+		require.Equal(t, true, status["reachable"])
+		require.Equal(t, false, status["authenticated"])
+		require.Contains(t, status["error"], "401")
+	})
+
+	t.Run("error answers mean reachable", func(t *testing.T) {
+		m.failRoute(http.MethodGet, licensesPath, http.StatusServiceUnavailable)
+		defer m.failRoute(http.MethodGet, licensesPath, 0)
+		require.NoError(t, s.Delete(ctx, statusProbePath+"mock"))
+		require.NoError(t, b.probeInstances(ctx, s))
+
+		resp := readStatus(t, "status/mock")
+		require.Equal(t, true, resp.Data["reachable"])
+		require.Equal(t, "", resp.Data["horizon_version"])
+	})
+
+	t.Run("failed rotation", func(t *testing.T) {
+		m.failRoute(http.MethodPatch, localsPath, http.StatusBadRequest)
+		defer m.failRoute(http.MethodPatch, localsPath, 0)
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "rotate-root/mock",
+			Storage:   s,
+		})
+		require.Error(t, err)
+
+		resp := readStatus(t, "status/mock")
+		rotation := resp.Data["last_root_rotation"].(map[string]interface{})
+		require.Equal(t, false, rotation["success"])
+		require.NotEmpty(t, rotation["error"])
+	})
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "status/unknown",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+}
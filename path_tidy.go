@@ -0,0 +1,372 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	tidyOrphansPath = "tidy/orphans/"
+
+	defaultTidySafetyBuffer = 72 * time.Hour
+)
+
+type tidyState int
+
+const (
+	tidyStateInactive tidyState = iota
+	tidyStateRunning
+	tidyStateFinished
+	tidyStateError
+)
+
+func (s tidyState) String() string {
+	switch s {
+	case tidyStateRunning:
+		return "Running"
+	case tidyStateFinished:
+		return "Finished"
+	case tidyStateError:
+		return "Error"
+	}
+	return "Inactive"
+}
+
+// tidyStatus is the progress of the last tidy operation. It is kept in
+// memory only, like the tidy status of the PKI engine.
+type tidyStatus struct {
+	lock sync.RWMutex
+
+	state        tidyState
+	instances    []string
+	safetyBuffer time.Duration
+	timeStarted  time.Time
+	timeFinished time.Time
+	message      string
+	err          error
+
+	checked int
+	orphans int
+	deleted int
+	errors  []string
+}
+
+func pathTidy(b *horizonBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "tidy$",
+			Fields: map[string]*framework.FieldSchema{
+				"instance": {
+					Type:        framework.TypeString,
+					Description: "Instance of horizon to tidy. Defaults to every instance.",
+				},
+				"safety_buffer": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time an account must have been found orphaned before it is deleted. Defaults to 72h.",
+					Default:     int(defaultTidySafetyBuffer.Seconds()),
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.pathTidyWrite,
+			},
+
+			HelpSynopsis:    pathTidyHelpSyn,
+			HelpDescription: pathTidyHelpDesc,
+		},
+		{
+			Pattern: "tidy-status$",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathTidyStatusRead,
+			},
+
+			HelpSynopsis:    pathTidyStatusHelpSyn,
+			HelpDescription: pathTidyStatusHelpDesc,
+		},
+	}
+}
+
+func (b *horizonBackend) pathTidyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	safetyBuffer := time.Duration(data.Get("safety_buffer").(int)) * time.Second
+	if safetyBuffer < 0 {
+		return logical.ErrorResponse("safety_buffer cannot be negative"), nil
+	}
+
+	instances := []string{data.Get("instance").(string)}
+	if instances[0] == "" {
+		var err error
+		instances, err = req.Storage.List(ctx, horizonConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := b.getConfig(ctx, req.Storage, instances[0]); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if !atomic.CompareAndSwapUint32(&b.tidyCASGuard, 0, 1) {
+		resp := &logical.Response{}
+		resp.AddWarning("Tidy operation already in progress.")
+		return resp, nil
+	}
+
+	b.tidyStatus.lock.Lock()
+	b.tidyStatus.state = tidyStateRunning
+	b.tidyStatus.instances = instances
+	b.tidyStatus.safetyBuffer = safetyBuffer
+	b.tidyStatus.timeStarted = time.Now()
+	b.tidyStatus.timeFinished = time.Time{}
+	b.tidyStatus.message = "Tidying orphaned accounts"
+	b.tidyStatus.err = nil
+	b.tidyStatus.checked = 0
+	b.tidyStatus.orphans = 0
+	b.tidyStatus.deleted = 0
+	b.tidyStatus.errors = nil
+	b.tidyStatus.lock.Unlock()
+
+	// The request context is done as soon as we answer.
+	s := req.Storage
+	go func() {
+		ctx := context.Background()
+		var err error
+		for _, instance := range instances {
+			if err = b.tidyInstance(ctx, s, instance, safetyBuffer); err != nil {
+				break
+			}
+		}
+
+		b.tidyStatus.lock.Lock()
+		defer b.tidyStatus.lock.Unlock()
+		// Released under the status lock, so that the next operation cannot
+		// start before this one is reported finished.
+		defer atomic.StoreUint32(&b.tidyCASGuard, 0)
+
+		b.tidyStatus.timeFinished = time.Now()
+		if err != nil {
+			b.Logger().Error("tidy failed", "operation", "tidy", "error", err)
+			b.tidyStatus.state = tidyStateError
+			b.tidyStatus.err = err
+			b.tidyStatus.message = "Tidy operation failed"
+			return
+		}
+		b.tidyStatus.state = tidyStateFinished
+		b.tidyStatus.message = "Tidy operation successfully completed"
+	}()
+
+	resp := &logical.Response{}
+	resp.AddWarning("Tidy operation successfully started. Its progress is reported by the tidy-status endpoint.")
+	return logical.RespondWithStatusCode(resp, req, 202)
+}
+
+// tidyInstance deletes the accounts of an instance that match its username
+// prefix, that the engine does not manage, and that an earlier pass found in
+// that state at least the safety buffer ago. Horizon does not expose when an
+// account was created, so the first time an account is found orphaned is
+// recorded in storage.
+func (b *horizonBackend) tidyInstance(ctx context.Context, s logical.Storage, instance string, safetyBuffer time.Duration) error {
+	lock := b.instanceLock(instance)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	config, err := b.getConfig(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+	if config.UsernamePrefix == "" {
+		// Without a naming scheme, our accounts cannot be told apart.
+		b.tidyError(fmt.Sprintf("instance %q: no username_prefix configured, skipped", instance))
+		return nil
+	}
+
+	client, err := b.newClient(instance, config)
+	if err != nil {
+		return err
+	}
+	accounts, err := client.listAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("instance %q: %w", instance, err)
+	}
+
+	// The accounts of in-flight credential requests are not in the
+	// inventory yet.
+	pending, err := pendingAccounts(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+	firstSeen, err := getTidyOrphans(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]time.Time)
+
+	now := time.Now()
+	for _, acc := range accounts {
+		// The engine's own account is not an orphan.
+		if !strings.HasPrefix(acc.Identifier, config.UsernamePrefix) || acc.Identifier == config.rootUsername() ||
+			pending[acc.Identifier] {
+			continue
+		}
+		b.tidyProgress(1, 0, 0)
+
+		managed, err := getManagedAccount(ctx, s, instance, acc.Identifier)
+		if err != nil {
+			return err
+		}
+		if managed != nil {
+			continue
+		}
+		// Library service accounts are shared, not in the inventory.
+		set, err := librarySetOf(ctx, s, instance, acc.Identifier, "")
+		if err != nil {
+			return err
+		}
+		if set != "" {
+			continue
+		}
+		b.tidyProgress(0, 1, 0)
+
+		since, ok := firstSeen[acc.Identifier]
+		if !ok {
+			since = now
+		}
+		// An account is only deleted when an earlier pass already found it
+		// orphaned, at least the safety buffer ago.
+		if !ok || now.Sub(since) < safetyBuffer {
+			seen[acc.Identifier] = since
+			continue
+		}
+
+		if err := client.deleteAccount(ctx, acc); err != nil && !isNotFound(err) {
+			seen[acc.Identifier] = since
+			b.tidyError(fmt.Sprintf("instance %q: %s: %s", instance, acc.Identifier, err))
+			b.Logger().Warn("failed to delete orphaned account", "operation", "tidy", "instance", instance, "account", acc.Identifier, "error", err)
+			continue
+		}
+		b.Logger().Info("deleted orphaned account", "operation", "tidy", "instance", instance, "account", acc.Identifier, "orphaned_since", since)
+		b.tidyProgress(0, 0, 1)
+	}
+
+	return putTidyOrphans(ctx, s, instance, seen)
+}
+
+func (b *horizonBackend) tidyProgress(checked int, orphans int, deleted int) {
+	b.tidyStatus.lock.Lock()
+	defer b.tidyStatus.lock.Unlock()
+	b.tidyStatus.checked += checked
+	b.tidyStatus.orphans += orphans
+	b.tidyStatus.deleted += deleted
+}
+
+func (b *horizonBackend) tidyError(msg string) {
+	b.tidyStatus.lock.Lock()
+	defer b.tidyStatus.lock.Unlock()
+	b.tidyStatus.errors = append(b.tidyStatus.errors, msg)
+}
+
+func (b *horizonBackend) pathTidyStatusRead(_ context.Context, _ *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	b.tidyStatus.lock.RLock()
+	defer b.tidyStatus.lock.RUnlock()
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"state":            b.tidyStatus.state.String(),
+			"instances":        nil,
+			"safety_buffer":    nil,
+			"time_started":     nil,
+			"time_finished":    nil,
+			"message":          nil,
+			"error":            nil,
+			"accounts_checked": nil,
+			"orphans_found":    nil,
+			"deleted_count":    nil,
+			"errors":           nil,
+		},
+	}
+
+	if b.tidyStatus.state == tidyStateInactive {
+		return resp, nil
+	}
+
+	resp.Data["instances"] = b.tidyStatus.instances
+	resp.Data["safety_buffer"] = b.tidyStatus.safetyBuffer.Seconds()
+	resp.Data["time_started"] = b.tidyStatus.timeStarted.Format(time.RFC3339)
+	resp.Data["message"] = b.tidyStatus.message
+	resp.Data["accounts_checked"] = b.tidyStatus.checked
+	resp.Data["orphans_found"] = b.tidyStatus.orphans
+	resp.Data["deleted_count"] = b.tidyStatus.deleted
+	resp.Data["errors"] = b.tidyStatus.errors
+	if !b.tidyStatus.timeFinished.IsZero() {
+		resp.Data["time_finished"] = b.tidyStatus.timeFinished.Format(time.RFC3339)
+	}
+	if b.tidyStatus.err != nil {
+		resp.Data["error"] = b.tidyStatus.err.Error()
+	}
+
+	return resp, nil
+}
+
+func getTidyOrphans(ctx context.Context, s logical.Storage, instance string) (map[string]time.Time, error) {
+	entry, err := s.Get(ctx, tidyOrphansPath+instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read orphaned accounts: %w", err)
+	}
+
+	orphans := make(map[string]time.Time)
+	if entry == nil {
+		return orphans, nil
+	}
+	if err := entry.DecodeJSON(&orphans); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+func putTidyOrphans(ctx context.Context, s logical.Storage, instance string, orphans map[string]time.Time) error {
+	if len(orphans) == 0 {
+		return s.Delete(ctx, tidyOrphansPath+instance)
+	}
+
+	entry, err := logical.StorageEntryJSON(tidyOrphansPath+instance, orphans)
+	if err != nil {
+		return fmt.Errorf("unable to marshal object to JSON: %w", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save orphaned accounts: %w", err)
+	}
+	return nil
+}
+
+const pathTidyHelpSyn = `
+Delete the orphaned horizon accounts left behind by the engine.
+`
+
+const pathTidyHelpDesc = `
+This endpoint starts a background job deleting the horizon accounts that
+match the "username_prefix" of an instance but are not managed by the engine,
+such as accounts left behind by failed credential requests or irrevocable
+leases. Instances without a "username_prefix" are skipped.
+
+Horizon does not tell when an account was created, so an orphaned account is
+only deleted once an earlier tidy found it orphaned, at least "safety_buffer"
+ago. Run tidy periodically for orphans to be deleted. Accounts whose creation
+by a credential request is still in progress are skipped.
+
+Progress is reported by the "tidy-status" endpoint.
+`
+
+const pathTidyStatusHelpSyn = `
+Returns the status of the tidy operation.
+`
+
+const pathTidyStatusHelpDesc = `
+This endpoint returns the state of the last tidy operation, when it started
+and finished, how many accounts were checked, found orphaned and deleted, and
+the errors it ran into.
+`
@@ -0,0 +1,122 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTidy(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"username_prefix": "vault-"})
+
+	require.NoError(t, putManagedAccount(ctx, s, &managedAccount{Instance: "mock", Username: "vault-live"}))
+	m.addAccount("vault-live")
+	m.addAccount("vault-orphan")
+	m.addAccount("someone-else")
+
+	tidy := func(safetyBuffer int) map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "tidy",
+			Storage:   s,
+			Data:      map[string]interface{}{"safety_buffer": safetyBuffer},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 202, resp.Data[logical.HTTPStatusCode])
+
+		var status map[string]interface{}
+		require.Eventually(t, func() bool {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "tidy-status",
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			status = resp.Data
+			return status["state"] == "Finished"
+		}, 5*time.Second, 10*time.Millisecond)
+		return status
+	}
+
+	// Found orphaned, but not for long enough yet.
+	status := tidy(3600)
+	require.Equal(t, 2, status["accounts_checked"])
+	require.Equal(t, 1, status["orphans_found"])
+	require.Equal(t, 0, status["deleted_count"])
+	require.NotNil(t, m.account("vault-orphan"))
+
+	orphans, err := getTidyOrphans(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Contains(t, orphans, "vault-orphan")
+
+	status = tidy(0)
+	require.Equal(t, 1, status["deleted_count"])
+	require.Nil(t, m.account("vault-orphan"))
+	require.NotNil(t, m.account("vault-live"))
+	require.NotNil(t, m.account("someone-else"))
+
+	orphans, err = getTidyOrphans(ctx, s, "mock")
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+}
+
+func TestTidyLibraryAccounts(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"username_prefix": "vault-"})
+
+	require.NoError(t, putLibrarySet(ctx, s, "automation", &librarySet{
+		Instance:            "mock",
+		ServiceAccountNames: []string{"vault-svc"},
+	}))
+	m.addAccount("vault-svc", "operator")
+	m.addAccount("vault-orphan")
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.tidyInstance(ctx, s, "mock", 0))
+	}
+	require.NotNil(t, m.account("vault-svc"))
+	require.Nil(t, m.account("vault-orphan"))
+}
+
+func TestTidyPendingAccounts(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, map[string]interface{}{"username_prefix": "vault-"})
+	m.addAccount("vault-creating")
+	m.addAccount("vault-orphan")
+
+	// A credential request is still setting this account up.
+	walID, err := framework.PutWAL(ctx, s, walTypeAccount, &walAccount{
+		Instance: "mock",
+		Username: "vault-creating",
+	})
+	require.NoError(t, err)
+
+	// A zero buffer still takes a second pass.
+	require.NoError(t, b.tidyInstance(ctx, s, "mock", 0))
+	require.NotNil(t, m.account("vault-orphan"))
+
+	require.NoError(t, b.tidyInstance(ctx, s, "mock", 0))
+	require.Nil(t, m.account("vault-orphan"))
+	require.NotNil(t, m.account("vault-creating"))
+
+	orphans, err := getTidyOrphans(ctx, s, "mock")
+	require.NoError(t, err)
+	require.NotContains(t, orphans, "vault-creating")
+
+	// Once set up, the account is in the inventory.
+	require.NoError(t, framework.DeleteWAL(ctx, s, walID))
+	require.NoError(t, putManagedAccount(ctx, s, &managedAccount{Instance: "mock", Username: "vault-creating"}))
+	require.NoError(t, b.tidyInstance(ctx, s, "mock", 0))
+	require.NotNil(t, m.account("vault-creating"))
+}
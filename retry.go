@@ -0,0 +1,193 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries       = 3
+	defaultRetryMinBackoff  = 250 * time.Millisecond
+	defaultRetryMaxBackoff  = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open, horizon is considered unavailable")
+
+// retryPolicy controls how many times, and how far apart, a failed Horizon
+// call is attempted again.
+type retryPolicy struct {
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// backoff returns the delay before the given retry attempt (starting at 0),
+// using exponential backoff with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = defaultRetryMinBackoff
+	}
+	if max < min {
+		max = min
+	}
+
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	return min + time.Duration(rand.Int63n(int64(d-min)+1))
+}
+
+// isRetryable reports whether err is a transient failure worth retrying:
+// transport errors, timeouts and Horizon answers that signal overload or
+// unavailability.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errCircuitOpen) {
+		return false
+	}
+
+	var respErr *horizonResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// mayHaveReachedHorizon reports whether a request that failed with err may
+// still have been carried out by Horizon: the answer was lost in transit, or
+// a gateway gave up waiting for it.
+func mayHaveReachedHorizon(err error) bool {
+	var respErr *horizonResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusGatewayTimeout
+	}
+	return isRetryable(err)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops calls to a Horizon instance after too many
+// consecutive transient failures. Once the cooldown has elapsed a single
+// probe call is let through; its outcome closes or reopens the circuit.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return errCircuitOpen
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		return nil
+	case breakerHalfOpen:
+		if cb.probing {
+			return errCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = breakerClosed
+	cb.failures = 0
+	cb.probing = false
+}
+
+func (cb *circuitBreaker) failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+	}
+	cb.probing = false
+}
+
+// release gives back a probe slot without reporting an outcome.
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+}
+
+func (cb *circuitBreaker) currentState() breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
@@ -0,0 +1,138 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Revocation modes, telling what happens to the Horizon account of a
+// credential when its lease ends.
+const (
+	// revocationModeDelete deletes the account.
+	revocationModeDelete = "delete"
+	// revocationModeDisable strips the roles of the account and scrambles its
+	// password, so that it can neither log in nor act, but still resolves in
+	// the Horizon audit trail.
+	revocationModeDisable = "disable"
+	// revocationModeRemoveRoles strips the roles of the account.
+	revocationModeRemoveRoles = "remove_roles"
+	// revocationModeScramblePassword sets a random password nobody knows.
+	revocationModeScramblePassword = "scramble_password"
+)
+
+func validRevocationMode(mode string) bool {
+	switch mode {
+	case revocationModeDelete, revocationModeDisable, revocationModeRemoveRoles, revocationModeScramblePassword:
+		return true
+	}
+	return false
+}
+
+// revokeAccount revokes a managed account according to mode and updates the
+// inventory. Accounts that are kept are marked revoked in the inventory, and
+// are purged once purgeAfter has elapsed, if set. The caller holds the lock
+// of the instance.
+func (b *horizonBackend) revokeAccount(ctx context.Context, s logical.Storage, instance string, username string, mode string, purgeAfter time.Duration) error {
+	if mode == "" || mode == revocationModeDelete {
+		if err := b.deleteHorizonAccount(ctx, s, instance, username); err != nil {
+			return err
+		}
+		return deleteManagedAccount(ctx, s, instance, username)
+	}
+
+	config, err := b.getConfig(ctx, s, instance)
+	if err != nil {
+		return err
+	}
+	client, err := b.newClient(instance, config)
+	if err != nil {
+		return err
+	}
+
+	acc, err := client.getAccount(ctx, username)
+	if isNotFound(err) {
+		return deleteManagedAccount(ctx, s, instance, username)
+	}
+	if err != nil {
+		return err
+	}
+
+	managed, err := getManagedAccount(ctx, s, instance, username)
+	if err != nil {
+		return err
+	}
+	if managed == nil {
+		managed = &managedAccount{
+			Instance: instance,
+			Username: username,
+		}
+	}
+
+	if mode == revocationModeDisable || mode == revocationModeRemoveRoles {
+		if err := client.assignRoles(ctx, acc, managed.Contact, []string{}); err != nil {
+			return err
+		}
+	}
+	if mode == revocationModeDisable || mode == revocationModeScramblePassword {
+		generator := passwordGenerator{PasswordPolicy: config.PasswordPolicy}
+		pwd, err := generator.generate(ctx, b)
+		if err != nil {
+			return fmt.Errorf("failed to generate password: %w", err)
+		}
+		if err := client.setPassword(ctx, acc, pwd); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	managed.RevokedAt = now
+	managed.RevocationMode = mode
+	if purgeAfter > 0 {
+		managed.PurgeAt = now.Add(purgeAfter)
+	}
+	return putManagedAccount(ctx, s, managed)
+}
+
+// revokeAccountLocked is revokeAccount for callers that do not hold the lock
+// of the instance.
+func (b *horizonBackend) revokeAccountLocked(ctx context.Context, s logical.Storage, instance string, username string, mode string, purgeAfter time.Duration) error {
+	lock := b.instanceLock(instance)
+	lock.RLock()
+	defer lock.RUnlock()
+	return b.revokeAccount(ctx, s, instance, username, mode, purgeAfter)
+}
+
+// purgeRevokedAccounts deletes the revoked accounts whose retention period
+// has elapsed.
+func (b *horizonBackend) purgeRevokedAccounts(ctx context.Context, s logical.Storage) error {
+	instances, err := s.List(ctx, managedAccountsPath)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	now := time.Now()
+	for _, instance := range instances {
+		accounts, err := listManagedAccounts(ctx, s, strings.TrimSuffix(instance, "/"))
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		for _, acc := range accounts {
+			if acc.PurgeAt.IsZero() || now.Before(acc.PurgeAt) {
+				continue
+			}
+			if err := b.revokeAccountLocked(ctx, s, acc.Instance, acc.Username, revocationModeDelete, 0); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("%s/%s: %w", acc.Instance, acc.Username, err))
+			}
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
@@ -0,0 +1,108 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationModes(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	m := newMockHorizon(t)
+	configureMockInstance(t, b, s, "mock", m, nil)
+
+	issue := func(t *testing.T, mode string, purgeAfter int) *logical.Response {
+		t.Helper()
+		_, err := testCredsRoleCreate(t, b, s, "role-"+mode, map[string]interface{}{
+			"instance":        "mock",
+			"roles":           []string{"operator"},
+			"contact":         "team@example.com",
+			"revocation_mode": mode,
+			"purge_after":     purgeAfter,
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/role-" + mode,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		return resp
+	}
+
+	revoke := func(t *testing.T, creds *logical.Response) string {
+		t.Helper()
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    creds.Secret,
+		})
+		require.NoError(t, err)
+		return creds.Data["username"].(string)
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		accUsername := revoke(t, issue(t, revocationModeDelete, 0))
+		require.Nil(t, m.account(accUsername))
+	})
+
+	t.Run("remove_roles", func(t *testing.T) {
+		creds := issue(t, revocationModeRemoveRoles, 0)
+		accUsername := revoke(t, creds)
+		require.NotNil(t, m.account(accUsername))
+		require.Empty(t, m.principal(accUsername).Roles)
+		require.Equal(t, creds.Data["password"], m.account(accUsername).Password)
+	})
+
+	t.Run("scramble_password", func(t *testing.T) {
+		creds := issue(t, revocationModeScramblePassword, 0)
+		accUsername := revoke(t, creds)
+		require.Equal(t, []string{"operator"}, m.principal(accUsername).Roles)
+		require.NotEqual(t, creds.Data["password"], m.account(accUsername).Password)
+	})
+
+	t.Run("disable and purge", func(t *testing.T) {
+		creds := issue(t, revocationModeDisable, 3600)
+		accUsername := revoke(t, creds)
+		require.Empty(t, m.principal(accUsername).Roles)
+		require.NotEqual(t, creds.Data["password"], m.account(accUsername).Password)
+
+		managed, err := getManagedAccount(ctx, s, "mock", accUsername)
+		require.NoError(t, err)
+		require.True(t, managed.revoked())
+		require.WithinDuration(t, time.Now().Add(time.Hour), managed.PurgeAt, time.Minute)
+
+		require.NoError(t, b.purgeRevokedAccounts(ctx, s))
+		require.NotNil(t, m.account(accUsername))
+
+		managed.PurgeAt = time.Now().Add(-time.Second)
+		require.NoError(t, putManagedAccount(ctx, s, managed))
+		require.NoError(t, b.purgeRevokedAccounts(ctx, s))
+		require.Nil(t, m.account(accUsername))
+
+		managed, err = getManagedAccount(ctx, s, "mock", accUsername)
+		require.NoError(t, err)
+		require.Nil(t, managed)
+	})
+
+	t.Run("invalid purge_after", func(t *testing.T) {
+		for name, d := range map[string]map[string]interface{}{
+			"negative":     {"revocation_mode": revocationModeDisable, "purge_after": -1},
+			"delete mode":  {"revocation_mode": revocationModeDelete, "purge_after": 3600},
+			"default mode": {"purge_after": 3600},
+		} {
+			t.Run(name, func(t *testing.T) {
+				d["instance"] = "mock"
+				resp, err := testCredsRoleCreate(t, b, s, "invalid-purge", d)
+				require.NoError(t, err)
+				require.True(t, resp.IsError())
+			})
+		}
+	})
+}
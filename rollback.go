@@ -0,0 +1,153 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	walTypeAccount      = "account"
+	walTypeRootPassword = "root-password"
+
+	// rollbackTimeout bounds the cleanup of a workflow whose request was
+	// cancelled. Cleanup does not use the request context, which is done.
+	rollbackTimeout = 30 * time.Second
+)
+
+// walAccount records a Horizon account being created. The entry is deleted
+// once the account is fully set up; a leftover entry means the workflow was
+// interrupted and the account has to be deleted.
+type walAccount struct {
+	Instance string `json:"instance" mapstructure:"instance"`
+	Username string `json:"username" mapstructure:"username"`
+}
+
+// walRootPassword records a root password rotation. A leftover entry means
+// the new password may have been set in Horizon without being stored.
+type walRootPassword struct {
+	Instance    string `json:"instance" mapstructure:"instance"`
+	Username    string `json:"username" mapstructure:"username"`
+	OldPassword string `json:"old_password" mapstructure:"old_password"`
+	NewPassword string `json:"new_password" mapstructure:"new_password"`
+}
+
+// pendingAccounts returns the usernames of the accounts of an instance that
+// a workflow is still setting up, according to their WAL entries.
+func pendingAccounts(ctx context.Context, s logical.Storage, instance string) (map[string]bool, error) {
+	ids, err := framework.ListWAL(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL entries: %w", err)
+	}
+
+	pending := make(map[string]bool)
+	for _, id := range ids {
+		wal, err := framework.GetWAL(ctx, s, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WAL entry: %w", err)
+		}
+		if wal == nil || wal.Kind != walTypeAccount {
+			continue
+		}
+		var entry walAccount
+		if err := mapstructure.Decode(wal.Data, &entry); err != nil {
+			return nil, err
+		}
+		if entry.Instance == instance {
+			pending[entry.Username] = true
+		}
+	}
+	return pending, nil
+}
+
+// walRollback is called by Vault for WAL entries left behind by interrupted
+// workflows.
+func (b *horizonBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case walTypeAccount:
+		var entry walAccount
+		if err := mapstructure.Decode(data, &entry); err != nil {
+			return err
+		}
+		lock := b.instanceLock(entry.Instance)
+		lock.RLock()
+		defer lock.RUnlock()
+		return b.rollbackAccount(ctx, req.Storage, entry)
+	case walTypeRootPassword:
+		var entry walRootPassword
+		if err := mapstructure.Decode(data, &entry); err != nil {
+			return err
+		}
+		lock := b.instanceLock(entry.Instance)
+		lock.Lock()
+		defer lock.Unlock()
+		return b.rollbackRootPassword(ctx, req.Storage, entry)
+	default:
+		return fmt.Errorf("unknown WAL entry type %q", kind)
+	}
+}
+
+// rollbackAccount deletes an account whose creation did not complete.
+func (b *horizonBackend) rollbackAccount(ctx context.Context, s logical.Storage, entry walAccount) error {
+	b.Logger().Debug("deleting account of an interrupted workflow", "instance", entry.Instance, "account", entry.Username)
+	return b.deleteHorizonAccount(ctx, s, entry.Instance, entry.Username)
+}
+
+// rollbackRootPassword puts the old root password back if the new one never
+// made it to storage.
+func (b *horizonBackend) rollbackRootPassword(ctx context.Context, s logical.Storage, entry walRootPassword) error {
+	config, err := b.getConfig(ctx, s, entry.Instance)
+	if err != nil {
+		return err
+	}
+	if config.ConnectionDetails["password"] == entry.NewPassword {
+		// The rotation completed.
+		return nil
+	}
+
+	client, err := b.newClient(entry.Instance, config)
+	if err != nil {
+		return err
+	}
+	client.withCredentials(entry.Username, entry.NewPassword)
+
+	root, err := client.getAccount(ctx, entry.Username)
+	if err != nil {
+		if isUnauthorized(err) {
+			// The new password was never set, the old one is still valid.
+			return nil
+		}
+		return err
+	}
+	b.Logger().Warn("putting back the root password of an interrupted rotation", "instance", entry.Instance)
+	return client.setPassword(ctx, root, entry.OldPassword)
+}
+
+// rollbackWorkflow undoes an interrupted workflow right away, and drops its
+// WAL entry on success. When it fails, the entry is left for walRollback.
+// The caller already holds the instance lock, so walRollback cannot be used.
+func (b *horizonBackend) rollbackWorkflow(s logical.Storage, walID string, kind string, data interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	var err error
+	var hidden []string
+	switch entry := data.(type) {
+	case *walAccount:
+		err = b.rollbackAccount(ctx, s, *entry)
+	case *walRootPassword:
+		err = b.rollbackRootPassword(ctx, s, *entry)
+		hidden = []string{entry.OldPassword, entry.NewPassword}
+	default:
+		err = fmt.Errorf("unknown WAL entry type %q", kind)
+	}
+	if err != nil {
+		b.Logger().Warn("failed to undo interrupted workflow, leaving it to the WAL rollback", "kind", kind, "wal_id", walID, "error", redact(err.Error(), hidden...))
+		return
+	}
+	_ = framework.DeleteWAL(ctx, s, walID)
+}
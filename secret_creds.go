@@ -3,10 +3,11 @@ package horizonsecretsengine
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"time"
 
-	horizon "github.com/evertrust/horizon-go"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -22,13 +23,6 @@ func secretCreds(b *horizonBackend) *framework.Secret {
 
 func (b *horizonBackend) secretCredsRenew() framework.OperationFunc {
 	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-		// Get the username from the internal data
-		usernameRaw, ok := req.Secret.InternalData["username"]
-		if !ok {
-			return nil, fmt.Errorf("secret is missing username internal data")
-		}
-		username := usernameRaw.(string)
-
 		roleNameRaw, ok := req.Secret.InternalData["role"]
 		if !ok {
 			return nil, fmt.Errorf("could not find role with name: %q", req.Secret.InternalData["role"])
@@ -43,26 +37,27 @@ func (b *horizonBackend) secretCredsRenew() framework.OperationFunc {
 			return nil, fmt.Errorf("error during renew: could not find role with name %q", req.Secret.InternalData["role"])
 		}
 
-		b.secretCredsRevoke()
-
-		config, err := b.getConfig(ctx, req.Storage, role.Instance)
-		if err != nil {
-			return nil, err
+		// Keep the TTL requested when the credential was issued.
+		ttl := role.TTL
+		if ttlRaw, ok := req.Secret.InternalData["ttl"]; ok {
+			ttl, err = parseutil.ParseDurationSecond(ttlRaw)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		endpoint, err := url.Parse(config.HorizonEndpoint)
+		resp := &logical.Response{Secret: req.Secret}
+		resp.Secret.TTL = ttl
+		resp.Secret.MaxTTL = role.MaxTTL
+
+		err = b.touchManagedAccount(ctx, req, ttl)
+		emitOutcome(err == nil, roleLabels(role.Instance, roleName), "creds", "renew")
 		if err != nil {
 			return nil, err
 		}
+		b.requestLogger(req, "renew", "role", roleName, "instance", role.Instance, "account", req.Secret.InternalData["username"]).
+			Debug("credential renewed", "ttl", ttl)
 
-		h := new(horizon.Horizon)
-		h.Init(*endpoint, config.ConnectionDetails["username"].(string), config.ConnectionDetails["password"].(string), "", "")
-
-		h.Local.Create(username, role.Contact)
-
-		resp := &logical.Response{Secret: req.Secret}
-		resp.Secret.TTL = role.TTL
-		resp.Secret.MaxTTL = role.MaxTTL
 		return resp, nil
 	}
 }
@@ -86,29 +81,75 @@ func (b *horizonBackend) secretCredsRevoke() framework.OperationFunc {
 		if err != nil {
 			return nil, err
 		}
-		if role == nil {
-			return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", roleName)), nil
+
+		// Leases issued before the instance was recorded only know the role.
+		instance, _ := req.Secret.InternalData["instance"].(string)
+		if instance == "" {
+			if role == nil {
+				return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", roleName)), nil
+			}
+			instance = role.Instance
 		}
 
-		config, err := b.getConfig(ctx, req.Storage, role.Instance)
-		if err != nil {
-			return nil, err
+		logger := b.requestLogger(req, "revoke", "role", roleName, "instance", instance, "account", username)
+
+		lock := b.instanceLock(instance)
+		lock.RLock()
+		defer lock.RUnlock()
+
+		// Accounts of deleted roles are deleted.
+		mode, purgeAfter := revocationModeDelete, time.Duration(0)
+		if role != nil && role.RevocationMode != "" {
+			mode, purgeAfter = role.RevocationMode, role.PurgeAfter
 		}
 
-		endpoint, err := url.Parse(config.HorizonEndpoint)
-		if err != nil {
-			return nil, err
+		// A per-entity account is only revoked with the last of its leases.
+		entityID, _ := req.Secret.InternalData["entity_id"].(string)
+		if accountMode, _ := req.Secret.InternalData["account_mode"].(string); accountMode == accountModePerEntity {
+			lock := b.entityLock(roleName, entityID)
+			lock.Lock()
+			defer lock.Unlock()
+
+			last, err := releaseEntityAccount(ctx, req.Storage, roleName, entityID)
+			if err != nil {
+				return nil, err
+			}
+			if !last {
+				logger.Debug("account still used by other leases of the entity", "entity_id", entityID)
+				return nil, b.releaseCredential(ctx, req.Storage, roleName)
+			}
+		} else {
+			entityID = ""
 		}
 
-		h := new(horizon.Horizon)
-		h.Init(*endpoint, config.ConnectionDetails["username"].(string), config.ConnectionDetails["password"].(string), "", "")
-		acc, err := h.Local.GetAccount(username)
-		if err != nil {
+		err = b.revokeAccount(ctx, req.Storage, instance, username, mode, purgeAfter)
+		emitOutcome(err == nil, roleLabels(instance, roleName), "creds", "revoke")
+		if err != nil && !isRevocationRetryable(err) {
+			logger.Error("failed to revoke account", "revocation_mode", mode, "error", err)
 			return nil, err
 		}
-
-		err = h.Local.Delete(acc)
 		if err != nil {
+			// Do not rely on the lease retries of Vault, which eventually
+			// give up: keep the account in our own queue until it is gone.
+			entry := &revocationQueueEntry{
+				Instance:       instance,
+				Username:       username,
+				Role:           roleName,
+				EntityID:       entityID,
+				LeaseID:        req.Secret.LeaseID,
+				RevocationMode: mode,
+				PurgeAfter:     purgeAfter,
+			}
+			if queueErr := queueRevocation(ctx, req.Storage, entry, err); queueErr != nil {
+				logger.Error("failed to revoke account and to queue its revocation", "error", err, "queue_error", queueErr)
+				return nil, multierror.Append(err, queueErr)
+			}
+			logger.Warn("failed to revoke account, queued for retry", "revocation_mode", mode, "error", err)
+			return nil, nil
+		}
+
+		logger.Info("credential revoked", "revocation_mode", mode)
+		if err := b.releaseCredential(ctx, req.Storage, roleName); err != nil {
 			return nil, err
 		}
 
@@ -117,3 +158,25 @@ func (b *horizonBackend) secretCredsRevoke() framework.OperationFunc {
 		return resp, nil
 	}
 }
+
+// touchManagedAccount records the lease of a renewed credential and its new
+// expiration in the inventory. The expiration is only ever extended: a
+// per-entity account may be shared by leases that outlive this one.
+func (b *horizonBackend) touchManagedAccount(ctx context.Context, req *logical.Request, ttl time.Duration) error {
+	username, _ := req.Secret.InternalData["username"].(string)
+	instance, _ := req.Secret.InternalData["instance"].(string)
+	if username == "" || instance == "" {
+		return nil
+	}
+
+	acc, err := getManagedAccount(ctx, req.Storage, instance, username)
+	if err != nil || acc == nil {
+		return err
+	}
+
+	acc.LeaseID = req.Secret.LeaseID
+	if expiresAt := time.Now().Add(ttl); expiresAt.After(acc.ExpiresAt) {
+		acc.ExpiresAt = expiresAt
+	}
+	return putManagedAccount(ctx, req.Storage, acc)
+}
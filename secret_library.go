@@ -0,0 +1,62 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const SecretLibraryType = "library"
+
+func secretLibrary(b *horizonBackend) *framework.Secret {
+	return &framework.Secret{
+		Type:   SecretLibraryType,
+		Fields: map[string]*framework.FieldSchema{},
+
+		Renew:  b.secretLibraryRenew,
+		Revoke: b.secretLibraryRevoke,
+	}
+}
+
+func (b *horizonBackend) secretLibraryRenew(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, _ := req.Secret.InternalData["set"].(string)
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, fmt.Errorf("error during renew: could not find set with name %q", name)
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = set.TTL
+	resp.Secret.MaxTTL = set.MaxTTL
+	return resp, nil
+}
+
+// secretLibraryRevoke checks the service account in when its lease ends,
+// unless it was checked in and lent again since.
+func (b *horizonBackend) secretLibraryRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, _ := req.Secret.InternalData["set"].(string)
+	account, _ := req.Secret.InternalData["service_account_name"].(string)
+	checkOutID, _ := req.Secret.InternalData["check_out_id"].(string)
+	if name == "" || account == "" {
+		return nil, fmt.Errorf("secret is missing set or service_account_name internal data")
+	}
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		// Sets cannot be deleted while accounts are checked out.
+		return nil, nil
+	}
+
+	if err := b.checkInLibraryAccount(ctx, req.Storage, name, set, account, checkOutID); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,60 @@
+package horizonsecretsengine
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Version and Commit identify the build. They are set at build time with:
+//
+//	go build -ldflags "-X github.com/evertrust/horizon-secret-engine.Version=v1.2.0 \
+//	  -X github.com/evertrust/horizon-secret-engine.Commit=$(git rev-parse --short HEAD)"
+//
+// Version is a semantic version with a leading v, as Vault expects.
+var (
+	Version = "v0.0.0-dev"
+	Commit  = ""
+)
+
+// VersionString describes the build, as printed by the --version flag.
+func VersionString() string {
+	if Commit == "" {
+		return fmt.Sprintf("horizon-secrets-engine %s", Version)
+	}
+	return fmt.Sprintf("horizon-secrets-engine %s (%s)", Version, Commit)
+}
+
+func pathVersion(b *horizonBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "version$",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathVersionRead,
+		},
+
+		HelpSynopsis:    pathVersionHelpSyn,
+		HelpDescription: pathVersionHelpDesc,
+	}
+}
+
+func (b *horizonBackend) pathVersionRead(_ context.Context, _ *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version":    Version,
+			"commit":     Commit,
+			"go_version": runtime.Version(),
+		},
+	}, nil
+}
+
+const pathVersionHelpSyn = `
+Report the version of the plugin.
+`
+
+const pathVersionHelpDesc = `
+This path reports the version and commit the running plugin was built from.
+`